@@ -4,14 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"os/exec"
 
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp"
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
 )
 
 func main() {
-    // Use stdio transport to connect to the server
-    transport := transports.NewStdioTransport()
+    // Launch the server as a subprocess and talk to it over its stdio. The
+    // server command can be given as arguments; by default the echo example
+    // is run.
+    args := os.Args[1:]
+    if len(args) == 0 {
+        args = []string{"go", "run", "./examples/echo"}
+    }
+    transport, err := transports.NewCommandTransport(exec.Command(args[0], args[1:]...))
+    if err != nil {
+        log.Fatal("Starting server failed:", err)
+    }
     client := mcp.NewClient(transport)
 
     // Test ListPrompts
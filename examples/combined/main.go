@@ -1,13 +1,13 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp"
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
 )
 
 func main() {
@@ -15,8 +15,8 @@ func main() {
     sr, cw := io.Pipe() // Server reads, Client writes
     cr, sw := io.Pipe() // Client reads, Server writes
 
-    serverTransport := &testTransport{Reader: sr, Writer: sw}
-    clientTransport := &testTransport{Reader: cr, Writer: cw}
+    serverTransport := transports.NewStreamTransport(sr, sw)
+    clientTransport := transports.NewStreamTransport(cr, cw)
 
     // Start the server
     server := mcp.NewServer()
@@ -58,35 +58,3 @@ func main() {
         log.Fatal("Close failed:", err)
     }
 }
-
-// testTransport mimics the transport interface for testing
-type testTransport struct {
-    Reader io.Reader
-    Writer io.Writer
-}
-
-func (t *testTransport) ReadMessage() (json.RawMessage, error) {
-    var buf bytes.Buffer
-    _, err := io.CopyN(&buf, t.Reader, 1024) // Arbitrary limit
-    if err != nil && err != io.EOF {
-        return nil, err
-    }
-    data := bytes.TrimSpace(buf.Bytes())
-    if len(data) == 0 {
-        return nil, io.EOF
-    }
-    var msg json.RawMessage
-    if err := json.Unmarshal(data, &msg); err != nil {
-        return nil, err
-    }
-    return msg, nil
-}
-
-func (t *testTransport) WriteMessage(message json.RawMessage) error {
-    _, err := t.Writer.Write(append(message, '\n'))
-    return err
-}
-
-func (t *testTransport) Close() error {
-    return nil
-}
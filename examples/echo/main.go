@@ -1,7 +1,8 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"log"
 
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp"
@@ -11,12 +12,13 @@ import (
 func main() {
 	// Create and configure the server
 	server := mcp.NewServer()
+	// Log to stderr: stdout carries the protocol.
 	server.SetOnStart(func() error {
-		fmt.Println("Server starting...")
+		log.Println("Server starting...")
 		return nil
 	})
 	server.SetOnStop(func() error {
-		fmt.Println("Server stopping...")
+		log.Println("Server stopping...")
 		return nil
 	})
 
@@ -37,11 +39,15 @@ func main() {
 		Template: "Hello, {{name}}!",
 	})
 
-	// Serve over stdio
+	// Serve over stdio until stdin is closed or SIGINT/SIGTERM arrives
 	transport := transports.NewStdioTransport()
-	if err := server.Serve(transport); err != nil {
-		log.Fatal(err)
+	err := mcp.Run(context.Background(), server, transport)
+	var sigErr *mcp.SignalError
+	if errors.Is(err, mcp.ErrTransportClosed) || errors.As(err, &sigErr) {
+		log.Println("Server stopped:", err)
+		return
 	}
+	log.Fatal(err)
 }
 
 // package main
@@ -0,0 +1,147 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// Batch collects several calls that are sent to the server as a single JSON-RPC batch.
+type Batch struct {
+	c        *Client
+	ctx      context.Context
+	requests []Request
+	ids      []ID
+	sent     chan struct{}
+	err      error
+}
+
+// Future holds the eventual result of a call added to a Batch.
+type Future[Resp any] struct {
+	b    *Batch
+	id   ID
+	ch   chan responseChan
+	mu   sync.Mutex
+	done bool
+	resp Resp
+	err  error
+}
+
+// Batch starts a new batch bound to ctx. Futures returned by the batch stop
+// waiting for their response once ctx is done.
+func (c *Client) Batch(ctx context.Context) *Batch {
+	return &Batch{
+		c:    c,
+		ctx:  ctx,
+		sent: make(chan struct{}),
+	}
+}
+
+// Call adds a call to the batch and returns a future for its raw result.
+func (b *Batch) Call(method string, params interface{}) *Future[json.RawMessage] {
+	return BatchCall[json.RawMessage](b, method, params)
+}
+
+// Notify adds a notification to the batch. Notifications receive no response.
+func (b *Batch) Notify(method string, params interface{}) {
+	req := Request{
+		JSONRPC: "2.0",
+		Method:  method,
+	}
+	if err := b.setParams(&req, params); err != nil {
+		b.err = err
+		return
+	}
+	b.requests = append(b.requests, req)
+}
+
+// BatchCall adds a call to the batch and returns a future for its typed result.
+func BatchCall[Resp any](b *Batch, method string, params interface{}) *Future[Resp] {
+	id, ch := b.c.newRequest()
+	req := Request{
+		JSONRPC: "2.0",
+		Method:  method,
+		ID:      id,
+	}
+	if err := b.setParams(&req, params); err != nil {
+		b.err = err
+	}
+	b.requests = append(b.requests, req)
+	b.ids = append(b.ids, id)
+	return &Future[Resp]{b: b, id: id, ch: ch}
+}
+
+func (b *Batch) setParams(req *Request, params interface{}) error {
+	if params == nil {
+		return nil
+	}
+	p, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req.Params = p
+	return nil
+}
+
+// Send writes the batch to the transport. It must be called exactly once,
+// after which the futures of the batch can be waited on.
+func (b *Batch) Send() error {
+	defer close(b.sent)
+	if b.err == nil && len(b.requests) == 0 {
+		b.err = errors.New("empty batch")
+	}
+	var data []byte
+	if b.err == nil {
+		data, b.err = json.Marshal(b.requests)
+	}
+	if b.err == nil {
+		b.err = b.c.transport.WriteMessage(data)
+	}
+	if b.err != nil {
+		b.c.mu.Lock()
+		for _, id := range b.ids {
+			delete(b.c.pendingRequests, id)
+		}
+		b.c.mu.Unlock()
+	}
+	return b.err
+}
+
+// Get waits for the response to the call and returns its result.
+// Once a response has been received, later calls return the same result.
+func (f *Future[Resp]) Get() (Resp, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return f.resp, f.err
+	}
+	select {
+	case <-f.b.sent:
+	case <-f.b.ctx.Done():
+		f.cancel()
+		return f.resp, f.b.ctx.Err()
+	}
+	if f.b.err != nil {
+		return f.resp, f.b.err
+	}
+	select {
+	case r := <-f.ch:
+		f.done = true
+		if r.err != nil {
+			f.err = r.err
+		} else if len(r.result) > 0 {
+			f.err = json.Unmarshal(r.result, &f.resp)
+		}
+		return f.resp, f.err
+	case <-f.b.ctx.Done():
+		f.cancel()
+		return f.resp, f.b.ctx.Err()
+	}
+}
+
+func (f *Future[Resp]) cancel() {
+	f.b.c.mu.Lock()
+	delete(f.b.c.pendingRequests, f.id)
+	f.b.c.mu.Unlock()
+}
@@ -1,9 +1,10 @@
 package mcp
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
 	"io"
+	"log"
 	"sync"
 
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
@@ -13,11 +14,17 @@ import (
 type Client struct {
 	transport            transports.Transport
 	notificationHandlers map[string]NotificationHandler
-	pendingRequests      map[int]chan responseChan // Changed from interface{}
+	pendingRequests      map[ID]chan responseChan
 	mu                   sync.Mutex
-	nextID               int
+	nextID               int64
 	stop                 chan struct{}
 	wg                   sync.WaitGroup
+	interceptors         []Interceptor
+	// compressed wraps the transport if message compression is enabled.
+	compressed *transports.CompressedTransport
+	// readErr is the error that ended the read loop. Requests sent
+	// afterwards fail with it.
+	readErr error
 }
 
 // NotificationHandler handles incoming notifications.
@@ -25,17 +32,20 @@ type NotificationHandler func(method string, params json.RawMessage) error
 
 type responseChan struct {
 	result json.RawMessage
-	err    *RPCError
+	err    error
 }
 
 // NewClient creates a new MCP client instance with the given transport.
-func NewClient(transport transports.Transport) *Client {
+func NewClient(transport transports.Transport, opts ...ClientOption) *Client {
 	c := &Client{
 		transport:            transport,
 		notificationHandlers: make(map[string]NotificationHandler),
-		pendingRequests:      make(map[int]chan responseChan),
+		pendingRequests:      make(map[ID]chan responseChan),
 		stop:                 make(chan struct{}),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
 	c.wg.Add(1)
 	go c.readLoop()
 	return c
@@ -60,57 +70,103 @@ func NewClient(transport transports.Transport) *Client {
 
 // handleMessage processes incoming messages.
 func (c *Client) handleMessage(msg json.RawMessage) {
-	var m map[string]interface{}
-	if err := json.Unmarshal(msg, &m); err != nil {
-		fmt.Println("Client handleMessage unmarshal error:", err)
-		return
-	}
-	if id, ok := m["id"]; ok {
-		var resp Response
-		if err := json.Unmarshal(msg, &resp); err != nil {
-			fmt.Println("Client handleMessage response unmarshal error:", err)
+	if isBatch(msg) {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(msg, &batch); err != nil {
+			log.Println("Client handleMessage batch unmarshal error:", err)
 			return
 		}
-		idInt := int(id.(float64))
-		c.mu.Lock()
-		ch, exists := c.pendingRequests[idInt]
-		if exists {
-			delete(c.pendingRequests, idInt)
-		}
-		c.mu.Unlock()
-		fmt.Println("Client handleMessage ID:", idInt, "exists:", exists)
-		if exists {
-			fmt.Println("Client sending response to channel:", string(resp.Result))
-			ch <- responseChan{result: resp.Result, err: resp.Error}
-			close(ch)
+		for _, entry := range batch {
+			c.handleMessage(entry)
 		}
+		return
+	}
+	var resp Response
+	if err := json.Unmarshal(msg, &resp); err != nil {
+		log.Println("Client handleMessage unmarshal error:", err)
+		return
+	}
+	if resp.ID.IsAbsent() {
+		c.handleNotification(msg)
+		return
 	}
+	c.mu.Lock()
+	ch, exists := c.pendingRequests[resp.ID]
+	if exists {
+		delete(c.pendingRequests, resp.ID)
+	}
+	c.mu.Unlock()
+	if !exists {
+		// The call was abandoned, e.g. because its context was cancelled.
+		return
+	}
+	r := responseChan{result: resp.Result}
+	if resp.Error != nil {
+		r.err = resp.Error
+	}
+	ch <- r
+	close(ch)
 }
 
-// CallRaw performs a JSON-RPC call and returns the raw result.
-func (c *Client) CallRaw(method string, params interface{}) (json.RawMessage, error) {
+// handleNotification passes a notification from the server to its registered handler.
+func (c *Client) handleNotification(msg json.RawMessage) {
+	var n Notification
+	if err := json.Unmarshal(msg, &n); err != nil {
+		log.Println("Client notification unmarshal error:", err)
+		return
+	}
 	c.mu.Lock()
-	id := c.nextID
-	c.nextID++
-	ch := make(chan responseChan, 1)
-	c.pendingRequests[id] = ch
+	handler, ok := c.notificationHandlers[n.Method]
 	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := handler(n.Method, n.Params); err != nil {
+		log.Println("Client notification handler error:", n.Method, err)
+	}
+}
+
+// CallRaw performs a JSON-RPC call and returns the raw result. Errors reported
+// by the server are returned as *RPCError.
+func (c *Client) CallRaw(method string, params interface{}) (json.RawMessage, error) {
+	return c.CallRawContext(context.Background(), method, params)
+}
+
+// CallRawContext is like CallRaw but stops waiting for the response once ctx
+// is done, in which case the server is sent a "notifications/cancelled"
+// notification for the request.
+func (c *Client) CallRawContext(ctx context.Context, method string, params interface{}) (json.RawMessage, error) {
+	return c.invoke(ctx, &Invocation{Method: method, Params: params})
+}
 
+// Notify sends a notification to the server.
+func (c *Client) Notify(ctx context.Context, method string, params interface{}) error {
+	_, err := c.invoke(ctx, &Invocation{Method: method, Params: params, Notification: true})
+	return err
+}
+
+// send is the innermost invoker of the interceptor chain. It writes the
+// invocation to the transport and, for calls, waits for the response.
+func (c *Client) send(ctx context.Context, inv *Invocation) (json.RawMessage, error) {
+	params, err := inv.encodeParams()
+	if err != nil {
+		return nil, err
+	}
 	req := Request{
 		JSONRPC: "2.0",
-		Method:  method,
-		ID:      id,
+		Method:  inv.Method,
+		Params:  params,
 	}
-	if params != nil {
-		p, err := json.Marshal(params)
+	if inv.Notification {
+		data, err := json.Marshal(req)
 		if err != nil {
-			c.mu.Lock()
-			delete(c.pendingRequests, id)
-			c.mu.Unlock()
 			return nil, err
 		}
-		req.Params = p
+		return nil, c.transport.WriteMessage(data)
 	}
+
+	id, ch := c.newRequest()
+	req.ID = id
 	data, err := json.Marshal(req)
 	if err != nil {
 		c.mu.Lock()
@@ -118,7 +174,6 @@ func (c *Client) CallRaw(method string, params interface{}) (json.RawMessage, er
 		c.mu.Unlock()
 		return nil, err
 	}
-	fmt.Println("Client sending request:", string(data))
 	if err := c.transport.WriteMessage(data); err != nil {
 		c.mu.Lock()
 		delete(c.pendingRequests, id)
@@ -126,35 +181,99 @@ func (c *Client) CallRaw(method string, params interface{}) (json.RawMessage, er
 		return nil, err
 	}
 
-	fmt.Println("Client waiting for response on ID:", id)
-	resp := <-ch
-	fmt.Println("Client received response:", resp.result, "err:", resp.err)
-	if resp.err != nil {
-		return nil, fmt.Errorf("rpc error: %s", resp.err.Message)
+	select {
+	case resp := <-ch:
+		if resp.err != nil {
+			return nil, resp.err
+		}
+		return resp.result, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pendingRequests, id)
+		c.mu.Unlock()
+		c.send(context.Background(), &Invocation{
+			Method:       "notifications/cancelled",
+			Params:       map[string]interface{}{"requestId": id, "reason": ctx.Err().Error()},
+			Notification: true,
+		})
+		return nil, ctx.Err()
+	}
+}
+
+// newRequest allocates a request ID and registers the channel its response
+// is delivered on. Once the read loop has ended, the channel holds its error.
+func (c *Client) newRequest() (ID, chan responseChan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := IntID(c.nextID)
+	c.nextID++
+	ch := make(chan responseChan, 1)
+	if c.readErr != nil {
+		ch <- responseChan{err: c.readErr}
+		close(ch)
+		return id, ch
+	}
+	c.pendingRequests[id] = ch
+	return id, ch
+}
+
+// failPending fails every request waiting for a response, and those sent
+// later, with the error that ended the read loop.
+func (c *Client) failPending(err error) {
+	c.mu.Lock()
+	c.readErr = err
+	pending := c.pendingRequests
+	c.pendingRequests = make(map[ID]chan responseChan)
+	c.mu.Unlock()
+	for _, ch := range pending {
+		ch <- responseChan{err: err}
+		close(ch)
 	}
-	return resp.result, nil
 }
 
 func (c *Client) readLoop() {
 	defer c.wg.Done()
-	for {
-		select {
-		case <-c.stop:
-			fmt.Println("Client readLoop stopped")
-			return
-		default:
+	// Read in a separate goroutine so that Close returns even if closing the
+	// transport does not unblock ReadMessage.
+	type readResult struct {
+		msg json.RawMessage
+		err error
+	}
+	reads := make(chan readResult)
+	go func() {
+		for {
 			msg, err := c.transport.ReadMessage()
-			if err == io.EOF {
-				fmt.Println("Client readLoop received EOF, stopping")
+			select {
+			case reads <- readResult{msg, err}:
+			case <-c.stop:
 				return
 			}
-			if err != nil {
-				fmt.Println("Client readLoop error:", err)
+			if err != nil && skippedMessageError(err) == nil {
 				return
 			}
-			fmt.Println("Client readLoop received:", string(msg))
-			c.handleMessage(msg)
 		}
+	}()
+	for {
+		var r readResult
+		select {
+		case r = <-reads:
+		case <-c.stop:
+			return
+		}
+		if r.err == io.EOF {
+			c.failPending(r.err)
+			return
+		}
+		if skippedMessageError(r.err) != nil {
+			log.Println("Client skipped message:", r.err)
+			continue
+		}
+		if r.err != nil {
+			log.Println("Client readLoop error:", r.err)
+			c.failPending(r.err)
+			return
+		}
+		c.handleMessage(r.msg)
 	}
 }
 
@@ -185,8 +304,42 @@ func (c *Client) Close() error {
 	c.mu.Lock()
 	close(c.stop)
 	c.mu.Unlock()
+	// Closing the transport first unblocks a readLoop waiting in ReadMessage.
+	err := c.transport.Close()
 	c.wg.Wait()
-	return c.transport.Close()
+	return err
+}
+
+// Initialize performs the initialize handshake, announcing the client's
+// implementation and capabilities, and then sends the
+// "notifications/initialized" notification.
+func (c *Client) Initialize(ctx context.Context, clientInfo Implementation, caps Capabilities) (*InitializeResult, error) {
+	if c.compressed != nil {
+		caps = withExperimentalCapability(caps, compressionCapability, map[string]interface{}{"encodings": transports.Compressors()})
+	}
+	params := InitializeParams{
+		ProtocolVersion: LatestProtocolVersion,
+		Capabilities:    caps,
+		ClientInfo:      clientInfo,
+	}
+	raw, err := c.CallRawContext(ctx, "initialize", params)
+	if err != nil {
+		return nil, err
+	}
+	var result InitializeResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, err
+	}
+	if c.compressed != nil {
+		encoding, _ := experimentalCapability(result.Capabilities, compressionCapability)["encoding"].(string)
+		if err := c.compressed.SetEncoding(encoding); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Notify(ctx, "notifications/initialized", nil); err != nil {
+		return nil, err
+	}
+	return &result, nil
 }
 
 // ListPrompts calls the "listPrompts" method with type safety.
@@ -0,0 +1,94 @@
+package mcp
+
+import (
+	"encoding/json"
+
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
+)
+
+// compressionCapability is the experimental capability negotiating message
+// compression. The client offers {"encodings": [...]}, and the server
+// answers with the {"encoding": ...} it picked.
+const compressionCapability = "compression"
+
+// SetMessageCompression makes the server compress messages of at least
+// threshold bytes for clients offering a registered coding during
+// initialize. Compression starts once the client has sent
+// "notifications/initialized". See transports.CompressedTransport.
+func (s *Server) SetMessageCompression(threshold int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compress = true
+	s.compressThreshold = threshold
+}
+
+// WithMessageCompression makes the client offer the registered codings
+// during Initialize, and compress messages of at least threshold bytes if
+// the server picks one.
+func WithMessageCompression(threshold int) ClientOption {
+	return func(c *Client) {
+		c.compressed = transports.NewCompressedTransport(c.transport, threshold)
+		c.transport = c.compressed
+	}
+}
+
+// startCompression starts compressing the messages sent to the client if
+// msg is its "notifications/initialized" after a coding was agreed. It is
+// called in the order messages are read, so that every response to a later
+// request is compressed.
+func (s *Session) startCompression(msg json.RawMessage) {
+	s.mu.Lock()
+	encoding := s.encoding
+	s.mu.Unlock()
+	if encoding == "" {
+		return
+	}
+	var n Notification
+	if json.Unmarshal(msg, &n) != nil || n.Method != "notifications/initialized" {
+		return
+	}
+	s.compressed.SetEncoding(encoding)
+	s.mu.Lock()
+	s.encoding = ""
+	s.mu.Unlock()
+}
+
+// experimentalCapability returns the experimental capability name from
+// caps, or nil.
+func experimentalCapability(caps Capabilities, name string) map[string]interface{} {
+	experimental, _ := caps["experimental"].(map[string]interface{})
+	capability, _ := experimental[name].(map[string]interface{})
+	return capability
+}
+
+// withExperimentalCapability returns a copy of caps with the experimental
+// capability name set to value.
+func withExperimentalCapability(caps Capabilities, name string, value interface{}) Capabilities {
+	merged := Capabilities{}
+	for k, v := range caps {
+		merged[k] = v
+	}
+	experimental := map[string]interface{}{}
+	if existing, ok := caps["experimental"].(map[string]interface{}); ok {
+		for k, v := range existing {
+			experimental[k] = v
+		}
+	}
+	experimental[name] = value
+	merged["experimental"] = experimental
+	return merged
+}
+
+// chooseEncoding returns the first registered coding the client offered in
+// its capabilities, or "".
+func chooseEncoding(caps Capabilities) string {
+	offered, _ := experimentalCapability(caps, compressionCapability)["encodings"].([]interface{})
+	for _, name := range transports.Compressors() {
+		for _, o := range offered {
+			if o == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
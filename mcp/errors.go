@@ -0,0 +1,108 @@
+package mcp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Standard JSON-RPC 2.0 error codes and the MCP specific codes used by the SDK.
+const (
+	CodeParseError       = -32700
+	CodeInvalidRequest   = -32600
+	CodeMethodNotFound   = -32601
+	CodeInvalidParams    = -32602
+	CodeInternalError    = -32603
+	CodeServerError      = -32000
+	CodeRequestTimeout   = -32001
+	CodeResourceNotFound = -32002
+	CodeServerBusy       = -32003
+)
+
+// Sentinel errors for the standard codes. They match any *RPCError with the
+// same code under errors.Is, so callers can write errors.Is(err, ErrMethodNotFound).
+var (
+	ErrParseError       = &RPCError{Code: CodeParseError, Message: "Parse error"}
+	ErrInvalidRequest   = &RPCError{Code: CodeInvalidRequest, Message: "Invalid Request"}
+	ErrMethodNotFound   = &RPCError{Code: CodeMethodNotFound, Message: "Method not found"}
+	ErrInvalidParams    = &RPCError{Code: CodeInvalidParams, Message: "Invalid params"}
+	ErrInternalError    = &RPCError{Code: CodeInternalError, Message: "Internal error"}
+	ErrResourceNotFound = &RPCError{Code: CodeResourceNotFound, Message: "Resource not found"}
+	ErrServerBusy       = &RPCError{Code: CodeServerBusy, Message: "Server busy"}
+	ErrRequestTimeout   = &RPCError{Code: CodeRequestTimeout, Message: "Request timed out"}
+)
+
+// Error implements the error interface.
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// Is reports whether target is an *RPCError with the same code.
+func (e *RPCError) Is(target error) bool {
+	t, ok := target.(*RPCError)
+	return ok && t.Code == e.Code
+}
+
+// NewRPCError creates an error with a custom code, message and data. Handlers
+// return it (possibly wrapped) to control the error sent to the client.
+func NewRPCError(code int, message string, data interface{}) *RPCError {
+	return &RPCError{Code: code, Message: message, Data: data}
+}
+
+// NewParseError creates a parse error. An empty message uses the standard one.
+func NewParseError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrParseError, message, data)
+}
+
+// NewInvalidRequestError creates an invalid request error. An empty message uses the standard one.
+func NewInvalidRequestError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrInvalidRequest, message, data)
+}
+
+// NewMethodNotFoundError creates a method not found error. An empty message uses the standard one.
+func NewMethodNotFoundError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrMethodNotFound, message, data)
+}
+
+// NewInvalidParamsError creates an invalid params error. An empty message uses the standard one.
+func NewInvalidParamsError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrInvalidParams, message, data)
+}
+
+// NewInternalError creates an internal error. An empty message uses the standard one.
+func NewInternalError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrInternalError, message, data)
+}
+
+// NewResourceNotFoundError creates a resource not found error. An empty message uses the standard one.
+func NewResourceNotFoundError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrResourceNotFound, message, data)
+}
+
+// NewRequestTimeoutError creates a request timeout error. An empty message uses the standard one.
+func NewRequestTimeoutError(message string, data interface{}) *RPCError {
+	return newStandardError(ErrRequestTimeout, message, data)
+}
+
+func newStandardError(std *RPCError, message string, data interface{}) *RPCError {
+	if message == "" {
+		message = std.Message
+	}
+	return &RPCError{Code: std.Code, Message: message, Data: data}
+}
+
+// toRPCError converts an error returned by a handler into the error object sent
+// to the client. An *RPCError anywhere in the chain is used as is, JSON decoding
+// errors become invalid params, and anything else is a generic server error.
+func toRPCError(err error) *RPCError {
+	var rpcErr *RPCError
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+		return NewInvalidParamsError(err.Error(), nil)
+	}
+	return &RPCError{Code: CodeServerError, Message: err.Error()}
+}
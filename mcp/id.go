@@ -0,0 +1,133 @@
+package mcp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+// ID is a JSON-RPC request identifier. It holds a string, an integer or null,
+// and distinguishes an absent id (the zero value, used by notifications) from
+// an explicit null. Integers are kept in their decimal form so they round-trip
+// exactly regardless of size. IDs are comparable and can be used as map keys.
+type ID struct {
+	kind  idKind
+	value string
+}
+
+type idKind uint8
+
+const (
+	idAbsent idKind = iota
+	idNull
+	idNumber
+	idString
+)
+
+// errInvalidID is returned when decoding an id that is not a string, an integer or null.
+var errInvalidID = errors.New("invalid id: must be a string, an integer or null")
+
+// NullID returns an explicit null id.
+func NullID() ID {
+	return ID{kind: idNull}
+}
+
+// IntID returns an integer id.
+func IntID(n int64) ID {
+	return ID{kind: idNumber, value: strconv.FormatInt(n, 10)}
+}
+
+// StringID returns a string id.
+func StringID(s string) ID {
+	return ID{kind: idString, value: s}
+}
+
+// IsZero reports whether the id is absent. It lets `omitzero` drop absent ids
+// when encoding.
+func (id ID) IsZero() bool {
+	return id.kind == idAbsent
+}
+
+// IsAbsent reports whether no id was present.
+func (id ID) IsAbsent() bool {
+	return id.kind == idAbsent
+}
+
+// IsNull reports whether the id is an explicit null.
+func (id ID) IsNull() bool {
+	return id.kind == idNull
+}
+
+// Int64 returns the id as an integer. The second result is false if the id is
+// not a number or does not fit in an int64.
+func (id ID) Int64() (int64, bool) {
+	if id.kind != idNumber {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(id.value, 10, 64)
+	return n, err == nil
+}
+
+// String returns the id formatted for logging.
+func (id ID) String() string {
+	switch id.kind {
+	case idNull:
+		return "null"
+	case idNumber:
+		return id.value
+	case idString:
+		return strconv.Quote(id.value)
+	}
+	return "<absent>"
+}
+
+// MarshalJSON implements json.Marshaler. Absent ids are encoded as null.
+func (id ID) MarshalJSON() ([]byte, error) {
+	switch id.kind {
+	case idNumber:
+		return []byte(id.value), nil
+	case idString:
+		return json.Marshal(id.value)
+	}
+	return []byte("null"), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler. It rejects fractional and
+// exponent numbers as well as any other JSON type.
+func (id *ID) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+		return errInvalidID
+	case string(data) == "null":
+		*id = NullID()
+	case data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = StringID(s)
+	case isInteger(data):
+		*id = ID{kind: idNumber, value: string(data)}
+	default:
+		return errInvalidID
+	}
+	return nil
+}
+
+// isInteger reports whether data is a JSON number without fraction or exponent.
+func isInteger(data []byte) bool {
+	if len(data) > 0 && data[0] == '-' {
+		data = data[1:]
+	}
+	if len(data) == 0 || (data[0] == '0' && len(data) > 1) {
+		return false
+	}
+	for _, c := range data {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,21 @@
+package mcp
+
+import (
+	"log"
+
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
+)
+
+// ConnectInProcess serves a new session of server over an in-memory
+// transport and returns a client connected to it. Closing the client ends the
+// session.
+func ConnectInProcess(server *Server, opts ...ClientOption) *Client {
+	serverTransport, clientTransport := transports.NewInMemoryPair()
+	go func() {
+		if err := server.Serve(serverTransport); err != nil {
+			log.Println("In-process server stopped:", err)
+		}
+		serverTransport.Close()
+	}()
+	return NewClient(clientTransport, opts...)
+}
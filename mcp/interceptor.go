@@ -0,0 +1,85 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// ClientOption configures a Client.
+type ClientOption func(*Client)
+
+// Invocation describes an outgoing call or notification as seen by interceptors.
+// Interceptors may change any field before passing it on.
+type Invocation struct {
+	Method string
+	Params interface{}
+	// Meta is merged into the "_meta" member of the encoded params, e.g. to
+	// propagate tracing headers.
+	Meta map[string]interface{}
+	// Notification is true for notifications, which have no result.
+	Notification bool
+}
+
+// Invoker sends an invocation and returns the raw result.
+type Invoker func(ctx context.Context, inv *Invocation) (json.RawMessage, error)
+
+// Interceptor wraps outgoing calls and notifications. It can modify the
+// invocation, call next zero or more times (e.g. to retry), and inspect or
+// replace the result and error.
+type Interceptor func(ctx context.Context, inv *Invocation, next Invoker) (json.RawMessage, error)
+
+// WithInterceptor appends an interceptor to the client's chain. Interceptors
+// added first run outermost. Calls sent as part of a Batch bypass the chain.
+func WithInterceptor(interceptor Interceptor) ClientOption {
+	return func(c *Client) {
+		c.interceptors = append(c.interceptors, interceptor)
+	}
+}
+
+// invoke runs inv through the interceptor chain.
+func (c *Client) invoke(ctx context.Context, inv *Invocation) (json.RawMessage, error) {
+	next := Invoker(c.send)
+	for i := len(c.interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := c.interceptors[i], next
+		next = func(ctx context.Context, inv *Invocation) (json.RawMessage, error) {
+			return interceptor(ctx, inv, inner)
+		}
+	}
+	return next(ctx, inv)
+}
+
+// encodeParams marshals the params and merges Meta into their "_meta" member.
+func (inv *Invocation) encodeParams() (json.RawMessage, error) {
+	var p json.RawMessage
+	if inv.Params != nil {
+		var err error
+		if p, err = json.Marshal(inv.Params); err != nil {
+			return nil, err
+		}
+	}
+	if len(inv.Meta) == 0 {
+		return p, nil
+	}
+	obj := map[string]json.RawMessage{}
+	if len(p) > 0 && string(p) != "null" {
+		if err := json.Unmarshal(p, &obj); err != nil {
+			return nil, errors.New("cannot attach _meta to params that are not an object")
+		}
+	}
+	meta := map[string]interface{}{}
+	if existing, ok := obj["_meta"]; ok {
+		if err := json.Unmarshal(existing, &meta); err != nil {
+			return nil, err
+		}
+	}
+	for k, v := range inv.Meta {
+		meta[k] = v
+	}
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	obj["_meta"] = m
+	return json.Marshal(obj)
+}
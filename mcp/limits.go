@@ -0,0 +1,334 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// QueuePolicy decides what happens to a request that arrives while the
+// concurrency limit is reached.
+type QueuePolicy int
+
+const (
+	// QueueBlock queues the request until a slot frees up, however long
+	// that takes. While the queue is full, the session's messages are left
+	// unread.
+	QueueBlock QueuePolicy = iota
+	// QueueReject immediately answers the request with ErrServerBusy.
+	QueueReject
+	// QueueDropOldest queues the request and, once the queue is full, answers
+	// the oldest queued request with ErrServerBusy to make room.
+	QueueDropOldest
+)
+
+// ConcurrencyLimits bounds the number of requests handled at the same time.
+// Zero values mean no limit. Notifications are never limited so that
+// cancellations always get through.
+type ConcurrencyLimits struct {
+	// MaxInFlight limits the requests in flight across all sessions.
+	MaxInFlight int
+	// MaxInFlightPerSession limits the requests in flight for each session.
+	MaxInFlightPerSession int
+	// MaxQueued limits the requests waiting for a slot: per limit under
+	// QueueDropOldest, per session under QueueBlock. Zero means the queue is
+	// as long as the limit it waits on.
+	MaxQueued int
+	// MaxBatchSize limits the entries of a batch. Larger batches are
+	// answered with an Invalid Request error. Zero means DefaultMaxBatchSize.
+	MaxBatchSize int
+	// Policy applies to all limits, including per-tool ones.
+	Policy QueuePolicy
+}
+
+// DefaultMaxBatchSize is the batch size limit used when
+// ConcurrencyLimits.MaxBatchSize is zero.
+const DefaultMaxBatchSize = 1000
+
+// sessionQueue returns the number of requests of a session that may wait for
+// a slot before Serve stops reading, or 0 if that is not limited.
+func (l ConcurrencyLimits) sessionQueue() int {
+	switch {
+	case l.Policy != QueueBlock:
+		return 0
+	case l.MaxQueued > 0:
+		return l.MaxQueued
+	case l.MaxInFlightPerSession > 0:
+		return l.MaxInFlightPerSession
+	}
+	return l.MaxInFlight
+}
+
+// batchSize returns the most entries a batch may have.
+func (l ConcurrencyLimits) batchSize() int {
+	if l.MaxBatchSize > 0 {
+		return l.MaxBatchSize
+	}
+	return DefaultMaxBatchSize
+}
+
+// SetConcurrencyLimits configures how many requests the server handles at once.
+// It must be called before Serve.
+func (s *Server) SetConcurrencyLimits(limits ConcurrencyLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits = limits
+	s.globalLimiter = newLimiter(limits.MaxInFlight)
+}
+
+// ToolOption configures a tool at registration.
+type ToolOption func(*toolEntry)
+
+// WithMaxConcurrency limits how many calls of the tool run at the same time.
+// Calls beyond the limit are queued or rejected according to the server's
+// QueuePolicy.
+func WithMaxConcurrency(n int) ToolOption {
+	return func(t *toolEntry) {
+		t.limiter = newLimiter(n)
+	}
+}
+
+// toolEntry is a registered tool with its options.
+type toolEntry struct {
+	handler Handler
+	limiter *limiter
+	timeout time.Duration
+}
+
+// limiter is a counting semaphore with a FIFO wait queue. A nil limiter
+// imposes no limit.
+type limiter struct {
+	mu      sync.Mutex
+	max     int
+	active  int
+	waiting []chan bool
+}
+
+func newLimiter(max int) *limiter {
+	if max <= 0 {
+		return nil
+	}
+	return &limiter{max: max}
+}
+
+// reserve takes a slot or a place in the wait queue. The returned channel
+// yields true once the slot is granted and false if the reservation was
+// dropped to make room for a newer one.
+func (l *limiter) reserve(policy QueuePolicy, maxQueued int) (chan bool, error) {
+	ch := make(chan bool, 1)
+	if l == nil {
+		ch <- true
+		return ch, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active < l.max {
+		l.active++
+		ch <- true
+		return ch, nil
+	}
+	switch policy {
+	case QueueReject:
+		return nil, ErrServerBusy
+	case QueueDropOldest:
+		if maxQueued <= 0 {
+			maxQueued = l.max
+		}
+		if len(l.waiting) >= maxQueued {
+			l.waiting[0] <- false
+			l.waiting = l.waiting[1:]
+		}
+	}
+	l.waiting = append(l.waiting, ch)
+	return ch, nil
+}
+
+// wait waits for a reservation to be granted.
+func (l *limiter) wait(ctx context.Context, ch chan bool) error {
+	select {
+	case ok := <-ch:
+		if !ok {
+			return ErrServerBusy
+		}
+		return nil
+	case <-ctx.Done():
+		l.cancel(ch)
+		return ctx.Err()
+	}
+}
+
+// cancel withdraws a reservation whose waiter gave up.
+func (l *limiter) cancel(ch chan bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	for i, w := range l.waiting {
+		if w == ch {
+			l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+			l.mu.Unlock()
+			return
+		}
+	}
+	l.mu.Unlock()
+	// The slot was granted concurrently; hand it back.
+	if granted := <-ch; granted {
+		l.release()
+	}
+}
+
+// release frees a slot, handing it to the oldest waiter if there is one.
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) > 0 {
+		l.waiting[0] <- true
+		l.waiting = l.waiting[1:]
+		return
+	}
+	l.active--
+}
+
+// acquire takes a slot from each limiter in turn. first, if not nil, is a
+// reservation already made on limiters[0]. The returned function releases the
+// slots.
+func acquire(ctx context.Context, limiters []*limiter, first chan bool, limits ConcurrencyLimits) (func(), error) {
+	var held []*limiter
+	release := func() {
+		for _, l := range held {
+			l.release()
+		}
+	}
+	for i, l := range limiters {
+		ch := first
+		if i > 0 || ch == nil {
+			var err error
+			if ch, err = l.reserve(limits.Policy, limits.MaxQueued); err != nil {
+				release()
+				return nil, err
+			}
+		}
+		if err := l.wait(ctx, ch); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, l)
+	}
+	return release, nil
+}
+
+// enqueue takes a place in the session's queue, waiting while it is full.
+// The place is given back with sess.queue.release once the request holds its
+// slots or gave up on them.
+func (sess *Session) enqueue(ctx context.Context) error {
+	ch, _ := sess.queue.reserve(QueueBlock, 0)
+	return sess.queue.wait(ctx, ch)
+}
+
+// admit handles msg once the session and global limits allow it. Waiting
+// for a slot happens in the background, so that Serve keeps reading and
+// notifications such as cancellations get through, unless the session's
+// queue is full under QueueBlock; a request that cannot get a slot is
+// answered with ErrServerBusy, and one arriving during Shutdown with
+// errShuttingDown. The entries of a batch each take their own slot.
+func (s *Server) admit(ctx context.Context, msg json.RawMessage, sess *Session) {
+	if !s.beginWork(!isNotification(msg)) {
+		if !isNotification(msg) {
+			go s.reject(sess, msg, errShuttingDown)
+		}
+		return
+	}
+	sess.wg.Add(1)
+	done := func() {
+		sess.wg.Done()
+		s.endWork()
+	}
+	if isNotification(msg) {
+		go func() {
+			defer done()
+			s.handleMessage(sess, msg)
+		}()
+		return
+	}
+	if isBatch(msg) {
+		s.handleBatch(ctx, sess, msg, done)
+		return
+	}
+	if err := sess.enqueue(ctx); err != nil {
+		go func() {
+			defer done()
+			s.reject(sess, msg, err)
+		}()
+		return
+	}
+	limits, limiters := s.limitsFor(sess)
+	// Reserve the session slot here so that queued requests keep the order
+	// in which they were read.
+	first, err := limiters[0].reserve(limits.Policy, limits.MaxQueued)
+	go func() {
+		defer done()
+		if err != nil {
+			sess.queue.release()
+			s.reject(sess, msg, err)
+			return
+		}
+		release, err := acquire(ctx, limiters, first, limits)
+		sess.queue.release()
+		if err != nil {
+			s.reject(sess, msg, err)
+			return
+		}
+		defer release()
+		s.handleMessage(sess, msg)
+	}()
+}
+
+// limitsFor returns the configured limits and the limiters a request of sess
+// takes a slot from, the session's first.
+func (s *Server) limitsFor(sess *Session) (ConcurrencyLimits, []*limiter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits, []*limiter{sess.limiter, s.globalLimiter}
+}
+
+// reject answers every request in msg with err.
+func (s *Server) reject(sess *Session, msg json.RawMessage, err error) {
+	rpcErr := toRPCError(err)
+	if !isBatch(msg) {
+		var req Request
+		json.Unmarshal(msg, &req)
+		s.writeResponse(sess, errorResponse(req.ID, rpcErr))
+		return
+	}
+	var batch []Request
+	json.Unmarshal(msg, &batch)
+	var out []*Response
+	for _, req := range batch {
+		if !req.ID.IsAbsent() {
+			out = append(out, errorResponse(req.ID, rpcErr))
+		}
+	}
+	if len(out) == 0 {
+		return
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+	sess.transport.WriteMessage(data)
+}
+
+// isNotification reports whether msg is a single request without an id.
+func isNotification(msg json.RawMessage) bool {
+	if isBatch(msg) {
+		return false
+	}
+	var m struct {
+		ID ID `json:"id"`
+	}
+	return json.Unmarshal(msg, &m) == nil && m.ID.IsAbsent()
+}
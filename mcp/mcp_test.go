@@ -2,11 +2,26 @@ package mcp
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
 )
 
 func TestServerClientIntegration(t *testing.T) {
@@ -131,3 +146,2355 @@ func (t *testTransport) WriteMessage(message json.RawMessage) error {
 func (t *testTransport) Close() error {
     return t.Writer.Close()
 }
+
+func TestBatch(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "test", Template: "Test {{value}}"})
+	server.RegisterHandler("add", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var p [2]int
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return p[0] + p[1], nil
+	})
+	client, cleanup := connectTestClient(t, server)
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batch := client.Batch(ctx)
+	sum := BatchCall[int](batch, "add", [2]int{2, 3})
+	prompt := BatchCall[Prompt](batch, "getPrompt", map[string]string{"name": "test"})
+	missing := batch.Call("missing", nil)
+	batch.Notify("add", [2]int{1, 1})
+	if err := batch.Send(); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	if got, err := sum.Get(); err != nil || got != 5 {
+		t.Errorf("add: got %d, %v; want 5", got, err)
+	}
+	if got, err := prompt.Get(); err != nil || got.Template != "Test {{value}}" {
+		t.Errorf("getPrompt: got %+v, %v", got, err)
+	}
+	if _, err := missing.Get(); err == nil {
+		t.Error("missing: expected an error")
+	}
+}
+
+func TestBatchServerResponses(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "test", Template: "Test {{value}}"})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go server.Serve(transports.NewStreamTransport(sr, sw))
+	defer cw.Close()
+	defer sw.Close()
+	reader := bufio.NewReader(cr)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", `[]`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"invalid entry", `[1]`, `[{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}]`},
+		{"fractional id", `{"jsonrpc":"2.0","method":"listPrompts","id":1.5}`, `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"mixed", `[{"jsonrpc":"2.0","method":"listPrompts","id":1},{"jsonrpc":"2.0","method":"listPrompts"},{"jsonrpc":"2.0","method":"nope","id":"b"}]`,
+			`[{"jsonrpc":"2.0","result":{"test":{"Name":"test","Template":"Test {{value}}"}},"id":1},{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found","data":"nope"},"id":"b"}]`},
+	}
+	for _, tt := range tests {
+		if _, err := cw.Write([]byte(tt.in + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		println("DEBUG wrote", tt.name)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(line); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSkippedMessages(t *testing.T) {
+	server := NewServer()
+	server.SetMessageCompression(1 << 20)
+	server.RegisterHandler("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return params, nil
+	})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(transports.NewStreamTransport(sr, sw, transports.WithMaxMessageSize(128)))
+	}()
+	reader := bufio.NewReader(cr)
+
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"too large", `{"jsonrpc":"2.0","method":"echo","params":"` + strings.Repeat("x", 128) + `","id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`},
+		{"malformed", `{"compressed":"gzip","data":"bm90IGd6aXA="}`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`},
+		{"next", `{"jsonrpc":"2.0","method":"echo","params":"ok","id":2}`, `{"jsonrpc":"2.0","result":"ok","id":2}`},
+	}
+	for _, tt := range tests {
+		if _, err := cw.Write([]byte(tt.in + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(line); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+	cw.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+
+	// A client's pending calls fail once its connection is gone.
+	serverTransport, clientTransport := transports.NewInMemoryPair()
+	client := NewClient(clientTransport)
+	defer client.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := client.CallRaw("echo", nil)
+		errc <- err
+	}()
+	if _, err := serverTransport.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	serverTransport.Close()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("pending call succeeded after the connection closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending call not failed after the connection closed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.CallRawContext(ctx, "echo", nil); err == nil || ctx.Err() != nil {
+		t.Errorf("call after the connection closed returned %v", err)
+	}
+}
+
+func TestIDRoundTrip(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ID
+		wantErr bool
+	}{
+		{in: `"abc"`, want: StringID("abc")},
+		{in: `""`, want: StringID("")},
+		{in: `42`, want: IntID(42)},
+		{in: `-7`, want: IntID(-7)},
+		{in: `12345678901234567890123`, want: ID{kind: idNumber, value: "12345678901234567890123"}},
+		{in: `null`, want: NullID()},
+		{in: `1.5`, wantErr: true},
+		{in: `1e3`, wantErr: true},
+		{in: `true`, wantErr: true},
+		{in: `{}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var req Request
+		err := json.Unmarshal([]byte(`{"jsonrpc":"2.0","method":"m","id":`+tt.in+`}`), &req)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected error, got %v", tt.in, req.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.in, err)
+			continue
+		}
+		if req.ID != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.in, req.ID, tt.want)
+		}
+		out, err := json.Marshal(req.ID)
+		if err != nil || string(out) != tt.in {
+			t.Errorf("%s: marshaled to %s, %v", tt.in, out, err)
+		}
+	}
+
+	var notification Request
+	if err := json.Unmarshal([]byte(`{"jsonrpc":"2.0","method":"m"}`), &notification); err != nil {
+		t.Fatal(err)
+	}
+	if !notification.ID.IsAbsent() {
+		t.Errorf("expected absent id, got %v", notification.ID)
+	}
+	out, _ := json.Marshal(notification)
+	if strings.Contains(string(out), `"id"`) {
+		t.Errorf("absent id should be omitted: %s", out)
+	}
+}
+
+func TestServerNotifications(t *testing.T) {
+	server := NewServer()
+	initialized := make(chan json.RawMessage, 1)
+	server.RegisterNotificationHandler("notifications/initialized", func(ctx context.Context, method string, params json.RawMessage) error {
+		if SessionFromContext(ctx) == nil {
+			t.Error("notification handled without a session")
+		}
+		initialized <- params
+		return nil
+	})
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	server.RegisterHandler("slow", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		cancelled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go server.Serve(transports.NewStreamTransport(sr, sw))
+	defer cw.Close()
+	defer sw.Close()
+	reader := bufio.NewReader(cr)
+	send := func(msg string) {
+		t.Helper()
+		if _, err := cw.Write([]byte(msg + "\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(`{"jsonrpc":"2.0","method":"notifications/initialized","params":{"ok":true}}`)
+	send(`{"jsonrpc":"2.0","method":"notifications/unknown"}`)
+	select {
+	case params := <-initialized:
+		if string(params) != `{"ok":true}` {
+			t.Errorf("unexpected params: %s", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification handler not called")
+	}
+
+	send(`{"jsonrpc":"2.0","method":"slow","id":"s1"}`)
+	<-started
+	send(`{"jsonrpc":"2.0","method":"notifications/cancelled","params":{"requestId":"s1","reason":"test"}}`)
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("unexpected context error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request was not cancelled")
+	}
+
+	// Neither the notifications nor the cancelled request may have produced
+	// output, so the next line read must be the response to this request.
+	send(`{"jsonrpc":"2.0","method":"listPrompts","id":2}`)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"jsonrpc":"2.0","result":{},"id":2}`; strings.TrimSpace(line) != want {
+		t.Errorf("got %s, want %s", strings.TrimSpace(line), want)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler("custom", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, fmt.Errorf("wrapped: %w", NewRPCError(-31000, "quota exceeded", map[string]int{"retryAfter": 30}))
+	})
+	server.RegisterHandler("plain", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("boom")
+	})
+	server.RegisterTool("typed", NewTool(func(p struct{ N int }) (int, error) {
+		return p.N, nil
+	}))
+	client, cleanup := connectTestClient(t, server)
+	defer cleanup()
+
+	_, err := client.CallRaw("custom", nil)
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) {
+		t.Fatalf("expected *RPCError, got %T: %v", err, err)
+	}
+	if rpcErr.Code != -31000 || rpcErr.Message != "quota exceeded" {
+		t.Errorf("unexpected error: %+v", rpcErr)
+	}
+	if data, ok := rpcErr.Data.(map[string]interface{}); !ok || data["retryAfter"] != float64(30) {
+		t.Errorf("unexpected data: %#v", rpcErr.Data)
+	}
+
+	tests := []struct {
+		method string
+		params interface{}
+		want   error
+		code   int
+	}{
+		{"missing", nil, ErrMethodNotFound, CodeMethodNotFound},
+		{"plain", nil, nil, CodeServerError},
+		{"getResource", map[string]string{"name": "nope"}, ErrResourceNotFound, CodeResourceNotFound},
+		{"executeTool", map[string]interface{}{"name": "typed", "params": map[string]string{"N": "x"}}, ErrInvalidParams, CodeInvalidParams},
+	}
+	for _, tt := range tests {
+		_, err := client.CallRaw(tt.method, tt.params)
+		if !errors.As(err, &rpcErr) || rpcErr.Code != tt.code {
+			t.Errorf("%s: got %v, want code %d", tt.method, err, tt.code)
+		}
+		if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v does not match %v", tt.method, err, tt.want)
+		}
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	server := NewServer()
+	server.RegisterTool("crash", NewTool(func(p struct{}) (string, error) {
+		panic("tool exploded")
+	}))
+	panics := make(chan PanicInfo, 1)
+	server.SetOnPanic(func(info PanicInfo) {
+		panics <- info
+	})
+	server.SetPanicStackInErrors(true)
+	client, cleanup := connectTestClient(t, server)
+	defer cleanup()
+
+	_, err := client.ExecuteTool("crash", struct{}{})
+	var rpcErr *RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != CodeInternalError {
+		t.Fatalf("expected internal error, got %v", err)
+	}
+	data, _ := rpcErr.Data.(map[string]interface{})
+	if data["panic"] != "tool exploded" || !strings.Contains(fmt.Sprint(data["stack"]), "TestPanicRecovery") {
+		t.Errorf("unexpected error data: %v", rpcErr.Data)
+	}
+	select {
+	case info := <-panics:
+		if info.Method != "executeTool" || info.Value != "tool exploded" || len(info.Stack) == 0 {
+			t.Errorf("unexpected panic info: %+v", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic hook not called")
+	}
+
+	if _, err := client.ListPrompts(); err != nil {
+		t.Errorf("server stopped serving after panic: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	server := NewServer()
+	server.RegisterTool("echo", NewTool(func(p struct{ Msg string }) (string, error) {
+		return p.Msg, nil
+	}))
+	server.RegisterTool("secret", NewTool(func(p struct{}) (string, error) {
+		return "classified", nil
+	}))
+	var mu sync.Mutex
+	var calls []string
+	server.Use(func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, req *Request) (interface{}, error) {
+			result, err := next(ctx, req)
+			mu.Lock()
+			calls = append(calls, fmt.Sprintf("%s:%v:%v", req.Method, req.ID, err != nil))
+			mu.Unlock()
+			return result, err
+		}
+	})
+	server.Use(ForTools(func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, req *Request) (interface{}, error) {
+			return nil, NewRPCError(-31001, "forbidden", nil)
+		}
+	}, "secret"))
+	server.Use(ForMethods(func(next RequestHandler) RequestHandler {
+		return func(ctx context.Context, req *Request) (interface{}, error) {
+			return map[string]Prompt{}, nil
+		}
+	}, "listPrompts"))
+	server.RegisterPrompt(Prompt{Name: "hidden"})
+	client, cleanup := connectTestClient(t, server)
+	defer cleanup()
+
+	if got, err := ExecuteTool[string](client, "echo", map[string]string{"Msg": "hi"}); err != nil || got != "hi" {
+		t.Errorf("echo: got %q, %v", got, err)
+	}
+	if _, err := client.ExecuteTool("secret", struct{}{}); !errors.Is(err, NewRPCError(-31001, "", nil)) {
+		t.Errorf("secret: expected forbidden error, got %v", err)
+	}
+	if prompts, err := client.ListPrompts(); err != nil || len(prompts) != 0 {
+		t.Errorf("listPrompts: got %v, %v", prompts, err)
+	}
+	if _, err := client.CallRaw("missing", nil); !errors.Is(err, ErrMethodNotFound) {
+		t.Errorf("missing: got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"executeTool:0:false", "executeTool:1:true", "listPrompts:2:false", "missing:3:true"}
+	if fmt.Sprint(calls) != fmt.Sprint(want) {
+		t.Errorf("got calls %v, want %v", calls, want)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	server := NewServer()
+	server.RegisterHandler("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return params, nil
+	})
+	attempts := 0
+	server.RegisterHandler("flaky", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, NewRPCError(-31002, "try again", nil)
+		}
+		return "ok", nil
+	})
+	notified := make(chan json.RawMessage, 1)
+	server.RegisterNotificationHandler("ping", func(ctx context.Context, method string, params json.RawMessage) error {
+		notified <- params
+		return nil
+	})
+
+	var order []string
+	trace := func(ctx context.Context, inv *Invocation, next Invoker) (json.RawMessage, error) {
+		order = append(order, "trace:"+inv.Method)
+		inv.Meta = map[string]interface{}{"traceparent": "00-abc-def-01"}
+		return next(ctx, inv)
+	}
+	retry := func(ctx context.Context, inv *Invocation, next Invoker) (json.RawMessage, error) {
+		order = append(order, "retry:"+inv.Method)
+		for {
+			result, err := next(ctx, inv)
+			if !errors.Is(err, NewRPCError(-31002, "", nil)) {
+				return result, err
+			}
+		}
+	}
+	cached := func(ctx context.Context, inv *Invocation, next Invoker) (json.RawMessage, error) {
+		if inv.Method == "cached" {
+			return json.RawMessage(`"from cache"`), nil
+		}
+		return next(ctx, inv)
+	}
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	go server.Serve(transports.NewStreamTransport(sr, sw))
+	client := NewClient(transports.NewStreamTransport(cr, cw),
+		WithInterceptor(trace), WithInterceptor(retry), WithInterceptor(cached))
+	defer func() {
+		client.Close()
+		sw.Close()
+	}()
+
+	raw, err := client.CallRaw("echo", map[string]interface{}{"a": 1, "_meta": map[string]string{"progressToken": "p"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"_meta":{"progressToken":"p","traceparent":"00-abc-def-01"},"a":1}`; string(raw) != want {
+		t.Errorf("echo: got %s, want %s", raw, want)
+	}
+	if got, err := Call[string](client, "flaky", nil); err != nil || got != "ok" || attempts != 3 {
+		t.Errorf("flaky: got %q, %v after %d attempts", got, err, attempts)
+	}
+	if got, err := Call[string](client, "cached", nil); err != nil || got != "from cache" {
+		t.Errorf("cached: got %q, %v", got, err)
+	}
+	if err := client.Notify(context.Background(), "ping", nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case params := <-notified:
+		if want := `{"_meta":{"traceparent":"00-abc-def-01"}}`; string(params) != want {
+			t.Errorf("ping: got %s, want %s", params, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+	want := []string{"trace:echo", "retry:echo", "trace:flaky", "retry:flaky", "trace:cached", "retry:cached", "trace:ping", "retry:ping"}
+	if fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestConcurrencyLimits(t *testing.T) {
+	newServer := func(limits ConcurrencyLimits) (*Server, chan struct{}, chan string) {
+		server := NewServer()
+		server.SetConcurrencyLimits(limits)
+		unblock := make(chan struct{})
+		started := make(chan string, 10)
+		server.RegisterHandler("wait", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			var name string
+			json.Unmarshal(params, &name)
+			started <- name
+			<-unblock
+			return name, nil
+		})
+		return server, unblock, started
+	}
+	call := func(client *Client, name string) chan error {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := Call[string](client, "wait", name)
+			errc <- err
+		}()
+		return errc
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		server, unblock, started := newServer(ConcurrencyLimits{MaxInFlight: 1, Policy: QueueReject})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		a := call(client, "a")
+		<-started
+		if err := <-call(client, "b"); !errors.Is(err, ErrServerBusy) {
+			t.Errorf("b: expected busy error, got %v", err)
+		}
+		close(unblock)
+		if err := <-a; err != nil {
+			t.Errorf("a: %v", err)
+		}
+	})
+
+	t.Run("block keeps reading", func(t *testing.T) {
+		server, unblock, started := newServer(ConcurrencyLimits{MaxInFlight: 1, Policy: QueueBlock})
+		pinged := make(chan struct{}, 1)
+		server.RegisterNotificationHandler("ping", func(ctx context.Context, method string, params json.RawMessage) error {
+			pinged <- struct{}{}
+			return nil
+		})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		a := call(client, "a")
+		<-started
+		b := call(client, "b")
+		time.Sleep(20 * time.Millisecond)
+		if err := client.Notify(context.Background(), "ping", nil); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not handled while a request was queued")
+		}
+		close(unblock)
+		for _, errc := range []chan error{a, b} {
+			if err := <-errc; err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	t.Run("batch", func(t *testing.T) {
+		server, unblock, started := newServer(ConcurrencyLimits{MaxInFlight: 1, Policy: QueueReject})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		batch := client.Batch(context.Background())
+		futures := []*Future[string]{BatchCall[string](batch, "wait", "a"), BatchCall[string](batch, "wait", "b")}
+		if err := batch.Send(); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		time.Sleep(20 * time.Millisecond)
+		close(unblock)
+		busy := 0
+		for _, f := range futures {
+			if _, err := f.Get(); errors.Is(err, ErrServerBusy) {
+				busy++
+			} else if err != nil {
+				t.Error(err)
+			}
+		}
+		if busy != 1 {
+			t.Errorf("%d batch entries rejected, want 1", busy)
+		}
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		server, unblock, started := newServer(ConcurrencyLimits{MaxInFlightPerSession: 1, MaxQueued: 1, Policy: QueueDropOldest})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		a := call(client, "a")
+		<-started
+		b := call(client, "b")
+		time.Sleep(50 * time.Millisecond)
+		c := call(client, "c")
+		if err := <-b; !errors.Is(err, ErrServerBusy) {
+			t.Errorf("b: expected busy error, got %v", err)
+		}
+		close(unblock)
+		if err := <-a; err != nil {
+			t.Errorf("a: %v", err)
+		}
+		if err := <-c; err != nil {
+			t.Errorf("c: %v", err)
+		}
+	})
+
+	t.Run("block stops reading", func(t *testing.T) {
+		server, unblock, started := newServer(ConcurrencyLimits{MaxInFlight: 1, MaxQueued: 1, Policy: QueueBlock})
+		pinged := make(chan struct{}, 1)
+		server.RegisterNotificationHandler("ping", func(ctx context.Context, method string, params json.RawMessage) error {
+			pinged <- struct{}{}
+			return nil
+		})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		release := sync.OnceFunc(func() { close(unblock) })
+		defer release()
+		a := call(client, "a")
+		<-started
+		b := call(client, "b")
+		time.Sleep(20 * time.Millisecond)
+		c := call(client, "c")
+		time.Sleep(20 * time.Millisecond)
+		go client.Notify(context.Background(), "ping", nil)
+		select {
+		case <-pinged:
+			t.Fatal("notification read while the queue was full")
+		case <-time.After(50 * time.Millisecond):
+		}
+		release()
+		for _, errc := range []chan error{a, b, c} {
+			if err := <-errc; err != nil {
+				t.Error(err)
+			}
+		}
+		select {
+		case <-pinged:
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not handled once the queue drained")
+		}
+	})
+
+	t.Run("batch size", func(t *testing.T) {
+		server, _, _ := newServer(ConcurrencyLimits{MaxBatchSize: 2})
+		serverTransport, clientTransport := transports.NewInMemoryPair()
+		go server.Serve(serverTransport)
+		defer clientTransport.Close()
+		batch := `[{"jsonrpc":"2.0","method":"ping","id":1},{"jsonrpc":"2.0","method":"ping","id":2},{"jsonrpc":"2.0","method":"ping","id":3}]`
+		if err := clientTransport.WriteMessage(json.RawMessage(batch)); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := clientTransport.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Error == nil || resp.Error.Code != CodeInvalidRequest {
+			t.Errorf("oversized batch: got %s", msg)
+		}
+	})
+
+	t.Run("per tool", func(t *testing.T) {
+		server := NewServer()
+		var mu sync.Mutex
+		running, peak := 0, 0
+		server.RegisterTool("expensive", NewTool(func(p struct{}) (int, error) {
+			mu.Lock()
+			running++
+			peak = max(peak, running)
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return 0, nil
+		}), WithMaxConcurrency(2))
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := client.ExecuteTool("expensive", struct{}{}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if peak > 2 {
+			t.Errorf("expected at most 2 concurrent calls, saw %d", peak)
+		}
+	})
+}
+
+func TestTimeouts(t *testing.T) {
+	server := NewServer()
+	server.SetDefaultTimeout(20 * time.Millisecond)
+	timeouts := make(chan TimeoutInfo, 10)
+	server.SetOnTimeout(func(info TimeoutInfo) {
+		timeouts <- info
+	})
+	server.RegisterHandler("stuck", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	server.RegisterHandler("partial", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		return "partial", nil
+	})
+	sleep := func(p struct{}) (string, error) {
+		time.Sleep(60 * time.Millisecond)
+		return "done", nil
+	}
+	server.RegisterTool("slow", NewTool(sleep), WithTimeout(time.Second))
+	server.RegisterTool("slower", NewTool(sleep))
+	client, cleanup := connectTestClient(t, server)
+	defer cleanup()
+
+	if _, err := client.CallRaw("stuck", nil); !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("stuck: expected timeout, got %v", err)
+	}
+	if info := <-timeouts; info.Method != "stuck" || info.Timeout != 20*time.Millisecond {
+		t.Errorf("unexpected timeout info: %+v", info)
+	}
+	if got, err := ExecuteTool[string](client, "slow", struct{}{}); err != nil || got != "done" {
+		t.Errorf("slow: got %q, %v", got, err)
+	}
+	if _, err := client.ExecuteTool("slower", struct{}{}); !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("slower: expected timeout, got %v", err)
+	}
+	if info := <-timeouts; info.Tool != "slower" {
+		t.Errorf("unexpected timeout info: %+v", info)
+	}
+
+	if _, err := client.CallRaw("partial", nil); !errors.Is(err, ErrRequestTimeout) {
+		t.Errorf("partial without grace: expected timeout, got %v", err)
+	}
+	<-timeouts
+	server.SetTimeoutGracePeriod(time.Second)
+	if got, err := Call[string](client, "partial", nil); err != nil || got != "partial" {
+		t.Errorf("partial with grace: got %q, %v", got, err)
+	}
+
+	t.Run("detached", func(t *testing.T) {
+		server := NewServer()
+		server.SetDefaultTimeout(20 * time.Millisecond)
+		server.SetConcurrencyLimits(ConcurrencyLimits{MaxInFlight: 1, Policy: QueueReject})
+		finish := make(chan struct{})
+		server.RegisterHandler("deaf", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			<-finish
+			return nil, nil
+		})
+		server.RegisterHandler("quick", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return "ok", nil
+		})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+
+		if _, err := client.CallRaw("deaf", nil); !errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("deaf: expected timeout, got %v", err)
+		}
+		// The handler ignoring its context still holds the only slot.
+		if _, err := client.CallRaw("quick", nil); !errors.Is(err, ErrServerBusy) {
+			t.Errorf("quick while deaf runs: expected ErrServerBusy, got %v", err)
+		}
+		close(finish)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err := client.CallRaw("quick", nil)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrServerBusy) || time.Now().After(deadline) {
+				t.Fatalf("quick after deaf returned: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("context tool", func(t *testing.T) {
+		server := NewServer()
+		server.SetConcurrencyLimits(ConcurrencyLimits{MaxInFlight: 1, Policy: QueueReject})
+		server.RegisterTool("stuck", NewToolContext(func(ctx context.Context, p struct{}) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		}), WithTimeout(20*time.Millisecond))
+		server.RegisterTool("quick", NewTool(func(p struct{}) (string, error) {
+			return "ok", nil
+		}))
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+
+		if _, err := client.ExecuteTool("stuck", struct{}{}); !errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("stuck: expected timeout, got %v", err)
+		}
+		// The cancelled tool returned and gave up its slot.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err := client.ExecuteTool("quick", struct{}{})
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, ErrServerBusy) || time.Now().After(deadline) {
+				t.Fatalf("quick after stuck: %v", err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("detached panic", func(t *testing.T) {
+		server := NewServer()
+		server.SetDefaultTimeout(20 * time.Millisecond)
+		panics := make(chan PanicInfo, 1)
+		server.SetOnPanic(func(info PanicInfo) {
+			panics <- info
+		})
+		finish := make(chan struct{})
+		server.RegisterHandler("deaf", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			<-finish
+			panic("late")
+		})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+
+		if _, err := client.CallRaw("deaf", nil); !errors.Is(err, ErrRequestTimeout) {
+			t.Errorf("deaf: expected timeout, got %v", err)
+		}
+		close(finish)
+		select {
+		case info := <-panics:
+			if info.Method != "deaf" || info.Value != "late" || len(info.Stack) == 0 {
+				t.Errorf("unexpected panic info: %+v", info)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("panic of detached handler not reported")
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	server := NewServer()
+	var hooks []string
+	server.SetOnStart(func() error {
+		hooks = append(hooks, "start")
+		return nil
+	})
+	server.SetOnStop(func() error {
+		hooks = append(hooks, "stop")
+		return nil
+	})
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	server.RegisterHandler("work", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		close(started)
+		<-finish
+		return "finished", nil
+	})
+	sr, cw := io.Pipe()
+	cr, sw := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(transports.NewStreamTransport(sr, sw))
+	}()
+	client := NewClient(transports.NewStreamTransport(cr, cw))
+	defer client.Close()
+
+	work := make(chan error, 1)
+	go func() {
+		got, err := Call[string](client, "work", nil)
+		if err == nil && got != "finished" {
+			err = fmt.Errorf("unexpected result %q", got)
+		}
+		work <- err
+	}()
+	<-started
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	for !server.isClosing() {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := client.ListPrompts(); !errors.Is(err, ErrServerBusy) {
+		t.Errorf("expected request during shutdown to be rejected, got %v", err)
+	}
+	close(finish)
+	if err := <-work; err != nil {
+		t.Errorf("in-flight request: %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if fmt.Sprint(hooks) != "[start stop]" {
+		t.Errorf("unexpected hooks: %v", hooks)
+	}
+	if err := server.Serve(transports.NewStreamTransport(sr, sw)); err != ErrServerClosed {
+		t.Errorf("Serve after Shutdown returned %v", err)
+	}
+
+	t.Run("deadline", func(t *testing.T) {
+		server := NewServer()
+		cancelled := make(chan struct{})
+		server.RegisterHandler("stuck", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		})
+		client, cleanup := connectTestClient(t, server)
+		defer cleanup()
+		go client.CallRaw("stuck", nil)
+		for {
+			server.mu.Lock()
+			active := server.active
+			server.mu.Unlock()
+			if active > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Shutdown returned %v", err)
+		}
+		<-cancelled
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		// With nothing in flight, Shutdown does not wait, so no work may
+		// start once it was called.
+		server := NewServer()
+		server.mu.Lock()
+		server.closing = true
+		server.mu.Unlock()
+		if server.beginWork(true) || server.beginWork(false) {
+			t.Error("work admitted after Shutdown found the server idle")
+		}
+	})
+
+	t.Run("start error", func(t *testing.T) {
+		server := NewServer()
+		server.SetOnStart(func() error {
+			return errors.New("no database")
+		})
+		if err := server.Serve(transports.NewStreamTransport(sr, sw)); err == nil || err.Error() != "no database" {
+			t.Errorf("Serve returned %v", err)
+		}
+	})
+}
+
+func TestRun(t *testing.T) {
+	t.Run("eof", func(t *testing.T) {
+		server := NewServer()
+		stopped := false
+		server.SetOnStop(func() error {
+			stopped = true
+			return nil
+		})
+		release := make(chan struct{})
+		server.RegisterHandler("slow", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			<-release
+			return "late result", nil
+		})
+		sr, cw := io.Pipe()
+		cr, sw := io.Pipe()
+		ran := make(chan error, 1)
+		go func() {
+			ran <- Run(context.Background(), server, transports.NewStreamTransport(sr, sw))
+		}()
+		cw.Write([]byte(`{"jsonrpc":"2.0","method":"slow","id":1}` + "\n"))
+		cw.Close()
+		close(release)
+		line, err := bufio.NewReader(cr).ReadString('\n')
+		if err != nil || !strings.Contains(line, "late result") {
+			t.Errorf("in-flight result lost: %q, %v", line, err)
+		}
+		if err := <-ran; err != ErrTransportClosed {
+			t.Errorf("Run returned %v, want ErrTransportClosed", err)
+		}
+		if !stopped {
+			t.Error("OnStop was not run")
+		}
+	})
+
+	t.Run("signal", func(t *testing.T) {
+		if runtime.GOOS == "windows" {
+			t.Skip("cannot send signals to self on windows")
+		}
+		server := NewServer()
+		started := make(chan struct{})
+		server.SetOnStart(func() error {
+			close(started)
+			return nil
+		})
+		sr, _ := io.Pipe()
+		_, sw := io.Pipe()
+		ran := make(chan error, 1)
+		go func() {
+			ran <- Run(context.Background(), server, transports.NewStreamTransport(sr, sw), WithSignals(os.Interrupt))
+		}()
+		<-started
+		self, _ := os.FindProcess(os.Getpid())
+		if err := self.Signal(os.Interrupt); err != nil {
+			t.Fatal(err)
+		}
+		var sigErr *SignalError
+		if err := <-ran; !errors.As(err, &sigErr) || sigErr.Signal != os.Interrupt {
+			t.Errorf("Run returned %v, want interrupt", err)
+		}
+	})
+
+	t.Run("context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		sr, _ := io.Pipe()
+		_, sw := io.Pipe()
+		cancel()
+		if err := Run(ctx, NewServer(), transports.NewStreamTransport(sr, sw)); err != context.Canceled {
+			t.Errorf("Run returned %v", err)
+		}
+	})
+}
+
+func TestSessions(t *testing.T) {
+	server := NewServer()
+	server.SetServerInfo("test-server", "1.2.3")
+	server.RegisterHandler("whoami", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		sess := SessionFromContext(ctx)
+		sess.Set("calls", 1)
+		return sess.ClientInfo().Name, nil
+	})
+	ctx := context.Background()
+	clients := make([]*Client, 2)
+	notified := make([]chan string, 2)
+	for i := range clients {
+		client, stop := connectTestClient(t, server)
+		defer stop()
+		clients[i] = client
+		ch := make(chan string, 2)
+		notified[i] = ch
+		client.RegisterNotificationHandler("notifications/message", func(method string, params json.RawMessage) error {
+			ch <- string(params)
+			return nil
+		})
+		result, err := client.Initialize(ctx, Implementation{Name: fmt.Sprint("client-", i), Version: "1"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ServerInfo.Name != "test-server" || result.ProtocolVersion != LatestProtocolVersion {
+			t.Errorf("unexpected initialize result: %+v", result)
+		}
+	}
+
+	for i, client := range clients {
+		name, err := Call[string](client, "whoami", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprint("client-", i); name != want {
+			t.Errorf("client %d routed to session of %s", i, name)
+		}
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 2 || sessions[0].ID() == sessions[1].ID() {
+		t.Fatalf("unexpected sessions: %v", sessions)
+	}
+	for _, sess := range sessions {
+		if v, ok := sess.Get("calls"); !ok || v != 1 {
+			t.Errorf("session %s: missing value", sess.ID())
+		}
+	}
+
+	var first *Session
+	for _, sess := range sessions {
+		if sess.ClientInfo().Name == "client-0" {
+			first = sess
+		}
+	}
+	if err := first.SendNotification("notifications/message", "only-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.BroadcastNotification("notifications/message", "all"); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{`"only-0"`, `"all"`}, {`"all"`}}
+	for i, ch := range notified {
+		for _, w := range want[i] {
+			select {
+			case got := <-ch:
+				if got != w {
+					t.Errorf("client %d: got notification %s, want %s", i, got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("client %d: notification %s not received", i, w)
+			}
+		}
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	server := NewServer()
+	counter := NewKey[int]("counter")
+	closed := make(chan []string, 1)
+	server.RegisterHandler("count", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		n, ok := counter.Value(ctx)
+		if !ok {
+			var order []string
+			sess := SessionFromContext(ctx)
+			sess.OnClose(func() {
+				order = append(order, "first")
+				closed <- order
+			})
+			sess.OnClose(func() { order = append(order, "second") })
+		}
+		counter.SetValue(ctx, n+1)
+		return n + 1, nil
+	})
+
+	client, stop := connectTestClient(t, server)
+	for want := 1; want <= 3; want++ {
+		n, err := Call[int](client, "count", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("got %d, want %d", n, want)
+		}
+	}
+	other, stopOther := connectTestClient(t, server)
+	defer stopOther()
+	if n, err := Call[int](other, "count", nil); err != nil || n != 1 {
+		t.Errorf("second session shares state: got %d, %v", n, err)
+	}
+
+	stop()
+	select {
+	case order := <-closed:
+		if strings.Join(order, ",") != "second,first" {
+			t.Errorf("OnClose callbacks ran in order %v", order)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose callbacks not run")
+	}
+
+	t.Run("type mismatch", func(t *testing.T) {
+		server := NewServer()
+		number := NewKey[int]("number")
+		server.RegisterHandler("check", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			SessionFromContext(ctx).Set(number, "not a number")
+			n, ok := number.Value(ctx)
+			return fmt.Sprint(n, " ", ok), nil
+		})
+		client, stop := connectTestClient(t, server)
+		defer stop()
+		if got, err := Call[string](client, "check", nil); err != nil || got != "0 false" {
+			t.Errorf("got %q, %v, want the zero value and false", got, err)
+		}
+	})
+}
+
+func TestStreamTransport(t *testing.T) {
+	input := "{\"a\":1}\r\n\n" + `{"big":"` + strings.Repeat("x", 64) + "\"}\n{\"b\":2}"
+	transport := transports.NewStreamTransport(io.NopCloser(strings.NewReader(input)), nopWriteCloser{io.Discard},
+		transports.WithMaxMessageSize(32))
+	want := []struct {
+		msg string
+		err error
+	}{
+		{`{"a":1}`, nil},
+		{"", transports.ErrMessageTooLarge},
+		{`{"b":2}`, nil},
+		{"", io.EOF},
+	}
+	for _, w := range want {
+		msg, err := transport.ReadMessage()
+		if string(msg) != w.msg || err != w.err {
+			t.Errorf("got %s, %v; want %s, %v", msg, err, w.msg, w.err)
+		}
+	}
+
+	// Close unblocks a pending read even if the reader can't be closed.
+	r, _ := io.Pipe()
+	transport = transports.NewStreamTransport(struct{ io.Reader }{r}, nopWriteCloser{io.Discard})
+	read := make(chan error, 1)
+	go func() {
+		_, err := transport.ReadMessage()
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	transport.Close()
+	select {
+	case err := <-read:
+		if err != io.EOF {
+			t.Errorf("ReadMessage returned %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock ReadMessage")
+	}
+	if err := transport.WriteMessage(json.RawMessage(`{}`)); err == nil {
+		t.Error("WriteMessage after Close succeeded")
+	}
+}
+
+func TestContentLengthFraming(t *testing.T) {
+	pretty := "{\n  \"a\": 1\n}"
+	big := `{"big":"` + strings.Repeat("x", 64) + `"}`
+	input := fmt.Sprintf("Content-Length: %d\r\nContent-Type: application/vscode-jsonrpc; charset=utf-8\r\n\r\n%s", len(pretty), pretty) +
+		fmt.Sprintf("\r\nContent-Length: %d\r\n\r\n%s", len(big), big) +
+		"Content-Length: 7\r\n\r\n{\"b\":2}"
+	var out strings.Builder
+	transport := transports.NewStreamTransport(io.NopCloser(strings.NewReader(input)), nopWriteCloser{&out},
+		transports.WithFraming(transports.FramingAuto), transports.WithMaxMessageSize(32))
+	want := []struct {
+		msg string
+		err error
+	}{
+		{pretty, nil},
+		{"", transports.ErrMessageTooLarge},
+		{`{"b":2}`, nil},
+		{"", io.EOF},
+	}
+	for _, w := range want {
+		msg, err := transport.ReadMessage()
+		if string(msg) != w.msg || err != w.err {
+			t.Errorf("got %s, %v; want %s, %v", msg, err, w.msg, w.err)
+		}
+	}
+	// Replies use the detected framing.
+	if err := transport.WriteMessage(json.RawMessage(pretty)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), fmt.Sprintf("Content-Length: %d\r\n\r\n%s", len(pretty), pretty); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	serverR, clientW := io.Pipe()
+	clientR, serverW := io.Pipe()
+	go server.Serve(transports.NewStreamTransport(serverR, serverW, transports.WithFraming(transports.FramingAuto)))
+	client := NewClient(transports.NewStreamTransport(clientR, clientW, transports.WithFraming(transports.FramingContentLength)))
+	defer client.Close()
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := client.GetPrompt("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Template != "Hello" {
+		t.Errorf("unexpected prompt: %+v", prompt)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestInMemoryTransport(t *testing.T) {
+	a, b := transports.NewInMemoryPair(transports.WithLatency(20 * time.Millisecond))
+	msg := json.RawMessage(`{"n":1}`)
+	start := time.Now()
+	if err := a.WriteMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg[5] = '2' // the transport must have copied the message
+	if err := a.WriteMessage(json.RawMessage(`{"n":3}`)); err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	for _, want := range []string{`{"n":1}`, `{"n":3}`} {
+		got, err := b.ReadMessage()
+		if err != nil || string(got) != want {
+			t.Errorf("got %s, %v; want %s", got, err, want)
+		}
+	}
+	if d := time.Since(start); d < 20*time.Millisecond {
+		t.Errorf("messages delivered after %v, before the latency", d)
+	}
+	if _, err := b.ReadMessage(); err != io.EOF {
+		t.Errorf("ReadMessage after Close returned %v, want io.EOF", err)
+	}
+	if err := b.WriteMessage(msg); err == nil {
+		t.Error("WriteMessage after Close succeeded")
+	}
+}
+
+func TestConnectInProcess(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	client := ConnectInProcess(server)
+	prompt, err := client.GetPrompt("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Template != "Hello" {
+		t.Errorf("unexpected prompt: %+v", prompt)
+	}
+	if err := client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not ended after the client closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSSEHandler(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	ts := httptest.NewServer(transports.NewSSEHandler(server, transports.WithHeartbeat(10*time.Millisecond)))
+	defer ts.Close()
+
+	clients := make([]*Client, 2)
+	for i := range clients {
+		clients[i] = NewClient(transports.NewSSETransport(ts.URL))
+		if _, err := clients[i].Initialize(context.Background(), Implementation{Name: fmt.Sprint("client-", i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(server.Sessions()); n != 2 {
+		t.Fatalf("got %d sessions, want 2", n)
+	}
+	// Outlive a few heartbeats.
+	time.Sleep(30 * time.Millisecond)
+	for _, client := range clients {
+		prompt, err := client.GetPrompt("greeting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prompt.Template != "Hello" {
+			t.Errorf("unexpected prompt: %+v", prompt)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+"/request?sessionId=unknown", "application/json", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST to unknown session: got status %d", resp.StatusCode)
+	}
+
+	for _, client := range clients {
+		client.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not torn down after the streams closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run("burst", func(t *testing.T) {
+		const count = 1000 // well over the event history of 256
+		server := NewServer()
+		server.RegisterHandler("burst", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			for i := 0; i < count; i++ {
+				if err := SessionFromContext(ctx).SendNotification("notifications/message", i); err != nil {
+					return nil, err
+				}
+			}
+			return "done", nil
+		})
+		ts := httptest.NewServer(transports.NewSSEHandler(server))
+		defer ts.Close()
+		client := NewClient(transports.NewSSETransport(ts.URL))
+		defer client.Close()
+		received := make(chan string, count)
+		client.RegisterNotificationHandler("notifications/message", func(method string, params json.RawMessage) error {
+			received <- string(params)
+			return nil
+		})
+		if _, err := client.CallRaw("burst", nil); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < count; i++ {
+			select {
+			case params := <-received:
+				if params != fmt.Sprint(i) {
+					t.Fatalf("notification %d: got %s", i, params)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("only %d of %d notifications received", i, count)
+			}
+		}
+	})
+}
+
+func TestStreamableHTTP(t *testing.T) {
+	newServer := func() *Server {
+		server := NewServer()
+		server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+		server.RegisterHandler("notify", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+			return "ok", SessionFromContext(ctx).SendNotification("notifications/message", params)
+		})
+		return server
+	}
+
+	for _, mode := range []struct {
+		name string
+		opts []transports.HandlerOption
+	}{
+		{"events", nil},
+		{"json", []transports.HandlerOption{transports.WithJSONResponses()}},
+	} {
+		t.Run(mode.name, func(t *testing.T) {
+			server := newServer()
+			ts := httptest.NewServer(transports.NewStreamableHTTPHandler(server, mode.opts...))
+			defer ts.Close()
+			transport := transports.NewStreamableHTTPTransport(ts.URL)
+			client := NewClient(transport)
+			notified := make(chan string, 1)
+			client.RegisterNotificationHandler("notifications/message", func(method string, params json.RawMessage) error {
+				notified <- string(params)
+				return nil
+			})
+			if _, err := client.Initialize(context.Background(), Implementation{Name: "test"}, nil); err != nil {
+				t.Fatal(err)
+			}
+			if transport.SessionID() == "" {
+				t.Fatal("no session ID assigned")
+			}
+
+			batch := client.Batch(context.Background())
+			prompt := BatchCall[Prompt](batch, "getPrompt", map[string]string{"name": "greeting"})
+			result := BatchCall[string](batch, "notify", "hi")
+			if err := batch.Send(); err != nil {
+				t.Fatal(err)
+			}
+			if p, err := prompt.Get(); err != nil || p.Template != "Hello" {
+				t.Errorf("getPrompt: %+v, %v", p, err)
+			}
+			if r, err := result.Get(); err != nil || r != "ok" {
+				t.Errorf("notify: %q, %v", r, err)
+			}
+			select {
+			case params := <-notified:
+				if params != `"hi"` {
+					t.Errorf("unexpected notification params: %s", params)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("notification not received on the GET stream")
+			}
+
+			client.Close()
+			deadline := time.Now().Add(5 * time.Second)
+			for len(server.Sessions()) > 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("session not terminated by DELETE")
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+
+	t.Run("sessions", func(t *testing.T) {
+		server := newServer()
+		ts := httptest.NewServer(transports.NewStreamableHTTPHandler(server, transports.WithJSONResponses(), transports.WithMaxBodySize(1024)))
+		defer ts.Close()
+		post := func(sessionID, body string) *http.Response {
+			t.Helper()
+			req, _ := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(body))
+			if sessionID != "" {
+				req.Header.Set(transports.SessionIDHeader, sessionID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp
+		}
+		if resp := post("", `{"jsonrpc":"2.0","method":"listPrompts","id":1}`); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("request without session: got status %d", resp.StatusCode)
+		}
+		if resp := post("unknown", `{"jsonrpc":"2.0","method":"listPrompts","id":1}`); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("request with unknown session: got status %d", resp.StatusCode)
+		}
+		resp := post("", `{"jsonrpc":"2.0","method":"initialize","params":{},"id":1}`)
+		sessionID := resp.Header.Get(transports.SessionIDHeader)
+		if sessionID == "" {
+			t.Fatal("initialize did not return a session ID")
+		}
+		// The server could only answer these with a null id, which matches
+		// no request of the POST.
+		for _, body := range []string{
+			`{"jsonrpc":"2.0","method":"listPrompts","id":1.5}`,
+			`{"jsonrpc":2,"method":"listPrompts","id":1}`,
+		} {
+			if resp := post(sessionID, body); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("POST %s: got status %d", body, resp.StatusCode)
+			}
+		}
+		big := `{"jsonrpc":"2.0","method":"listPrompts","params":"` + strings.Repeat("x", 1024) + `","id":1}`
+		if resp := post(sessionID, big); resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Errorf("oversized POST: got status %d", resp.StatusCode)
+		}
+
+		// With no GET stream open the notifications are kept, so a stream
+		// resuming after the first one gets the others.
+		for i := 1; i <= 3; i++ {
+			if err := server.BroadcastNotification("notifications/message", i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set(transports.SessionIDHeader, sessionID)
+		req.Header.Set("Last-Event-ID", "1")
+		stream, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Body.Close()
+		reader := bufio.NewReader(stream.Body)
+		var ids []string
+		for len(ids) < 2 {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id, ok := strings.CutPrefix(strings.TrimSpace(line), "id: "); ok {
+				ids = append(ids, id)
+			}
+		}
+		if strings.Join(ids, ",") != "2,3" {
+			t.Errorf("resumed stream sent events %v, want 2,3", ids)
+		}
+	})
+
+	t.Run("no stream", func(t *testing.T) {
+		// A client need not open the GET stream; notifications for it must
+		// not hold up the server.
+		server := newServer()
+		ts := httptest.NewServer(transports.NewStreamableHTTPHandler(server, transports.WithJSONResponses()))
+		defer ts.Close()
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"initialize","params":{},"id":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		sent := make(chan error, 1)
+		go func() {
+			for i := 0; i < 1000; i++ {
+				if err := server.BroadcastNotification("notifications/message", i); err != nil {
+					sent <- err
+					return
+				}
+			}
+			sent <- nil
+		}()
+		select {
+		case err := <-sent:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("notifications blocked on a session without a GET stream")
+		}
+	})
+
+	t.Run("evicted", func(t *testing.T) {
+		server := newServer()
+		ts := httptest.NewServer(transports.NewStreamableHTTPHandler(server,
+			transports.WithJSONResponses(), transports.WithEventHistory(1)))
+		defer ts.Close()
+		resp, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"initialize","params":{},"id":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		sessionID := resp.Header.Get(transports.SessionIDHeader)
+		get := func(lastEventID string) *http.Response {
+			t.Helper()
+			req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+			req.Header.Set("Accept", "text/event-stream")
+			req.Header.Set(transports.SessionIDHeader, sessionID)
+			if lastEventID != "" {
+				req.Header.Set("Last-Event-ID", lastEventID)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return resp
+		}
+
+		stream := get("")
+		reader := bufio.NewReader(stream.Body)
+		for i := 1; i <= 3; i++ {
+			if err := server.BroadcastNotification("notifications/message", i); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.HasPrefix(line, "id: ") {
+					break
+				}
+			}
+		}
+		stream.Body.Close()
+
+		// Only the last event is kept, so the events after the first can no
+		// longer be replayed and the session ends.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp := get("1")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusConflict {
+				if resp.StatusCode != http.StatusNotFound {
+					t.Errorf("resuming after an evicted event: got status %d", resp.StatusCode)
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("previous event stream not closed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		for len(server.Sessions()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("session not ended")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+	t.Run("session limits", func(t *testing.T) {
+		server := newServer()
+		ts := httptest.NewServer(transports.NewStreamableHTTPHandler(server, transports.WithJSONResponses(),
+			transports.WithMaxSessions(1), transports.WithSessionIdleTimeout(50*time.Millisecond)))
+		defer ts.Close()
+		initialize := func() int {
+			t.Helper()
+			resp, err := http.Post(ts.URL, "application/json", strings.NewReader(`{"jsonrpc":"2.0","method":"initialize","params":{},"id":1}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			return resp.StatusCode
+		}
+		if status := initialize(); status != http.StatusOK {
+			t.Fatalf("first initialize: got status %d", status)
+		}
+		if status := initialize(); status != http.StatusServiceUnavailable {
+			t.Errorf("initialize over the session limit: got status %d", status)
+		}
+		// The abandoned session expires, making room for another.
+		deadline := time.Now().Add(5 * time.Second)
+		for len(server.Sessions()) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("idle session not ended")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if status := initialize(); status != http.StatusOK {
+			t.Errorf("initialize after the idle session ended: got status %d", status)
+		}
+	})
+}
+
+func TestSSEReconnect(t *testing.T) {
+	server := NewServer()
+	key := NewKey[string]("value")
+	server.RegisterHandler("remember", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		key.SetValue(ctx, string(params))
+		return nil, nil
+	})
+	server.RegisterHandler("recall", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		v, _ := key.Value(ctx)
+		return v, nil
+	})
+	ts := httptest.NewServer(transports.NewSSEHandler(server, transports.WithResumeWindow(5*time.Second)))
+	defer ts.Close()
+
+	states := make(chan transports.ConnectionState, 16)
+	policy := transports.ReconnectPolicy{InitialDelay: 20 * time.Millisecond, MaxDelay: 100 * time.Millisecond, Multiplier: 2}
+	client := NewClient(transports.NewSSETransport(ts.URL,
+		transports.WithReconnectPolicy(policy),
+		transports.WithConnectionStateHandler(func(state transports.ConnectionState, err error) {
+			states <- state
+		})))
+	defer client.Close()
+	notified := make(chan string, 1)
+	client.RegisterNotificationHandler("notifications/message", func(method string, params json.RawMessage) error {
+		notified <- string(params)
+		return nil
+	})
+	waitState := func(want transports.ConnectionState) {
+		t.Helper()
+		for {
+			select {
+			case state := <-states:
+				if state == want {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("state %v not reached", want)
+			}
+		}
+	}
+	waitState(transports.StateConnected)
+	if _, err := client.CallRaw("remember", "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	ts.CloseClientConnections()
+	// Sent while the stream is down, so it must be replayed.
+	if err := server.BroadcastNotification("notifications/message", "missed"); err != nil {
+		t.Fatal(err)
+	}
+	waitState(transports.StateReconnecting)
+	waitState(transports.StateConnected)
+	select {
+	case params := <-notified:
+		if params != `"missed"` {
+			t.Errorf("unexpected notification: %s", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("missed notification not replayed")
+	}
+	if v, err := Call[string](client, "recall", nil); err != nil || v != `"kept"` {
+		t.Errorf("session not resumed: got %q, %v", v, err)
+	}
+	if n := len(server.Sessions()); n != 1 {
+		t.Errorf("got %d sessions, want 1", n)
+	}
+
+	t.Run("failure", func(t *testing.T) {
+		ts := httptest.NewServer(http.NotFoundHandler())
+		defer ts.Close()
+		failed := make(chan error, 1)
+		transport := transports.NewSSETransport(ts.URL,
+			transports.WithConnectionStateHandler(func(state transports.ConnectionState, err error) {
+				if state == transports.StateFailed {
+					failed <- err
+				}
+			}))
+		defer transport.Close()
+		if _, err := transport.ReadMessage(); err == nil || err == io.EOF {
+			t.Errorf("ReadMessage returned %v, want the failure", err)
+		}
+		if err := <-failed; err == nil {
+			t.Error("StateFailed reported without an error")
+		}
+	})
+
+	t.Run("session lost", func(t *testing.T) {
+		server := NewServer()
+		ts := httptest.NewServer(transports.NewSSEHandler(server, transports.WithResumeWindow(0)))
+		defer ts.Close()
+		transport := transports.NewSSETransport(ts.URL,
+			transports.WithReconnectPolicy(transports.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 1}))
+		client := NewClient(transport)
+		defer client.Close()
+		if _, err := client.CallRaw("listPrompts", nil); err != nil {
+			t.Fatal(err)
+		}
+		ts.CloseClientConnections()
+		read := make(chan error, 1)
+		go func() {
+			_, err := transport.ReadMessage()
+			read <- err
+		}()
+		select {
+		case err := <-read:
+			if !errors.Is(err, transports.ErrSessionNotFound) {
+				t.Errorf("ReadMessage returned %v, want ErrSessionNotFound", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("loss of the session not reported")
+		}
+	})
+}
+
+func TestSSEParsing(t *testing.T) {
+	big := `{"jsonrpc":"2.0","method":"big","params":"` + strings.Repeat("x", 100000) + `"}`
+	lastEventIDs := make(chan string, 2)
+	posted := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp/events", func(w http.ResponseWriter, r *http.Request) {
+		lastEventIDs <- r.Header.Get("Last-Event-ID")
+		w.Header().Set("Content-Type", "text/event-stream")
+		if r.Header.Get("Last-Event-ID") != "" {
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "\ufeff: comment\r\nevent: endpoint\r\ndata: post\r\n\r\n")
+		io.WriteString(w, "event: progress\ndata: 50\n\n")
+		io.WriteString(w, "id: 7\n\n")
+		io.WriteString(w, "data: {\"jsonrpc\":\"2.0\",\rdata:\"method\":\"split\"}\r\r")
+		io.WriteString(w, "data: "+big+"\n\n")
+		io.WriteString(w, "data: "+strings.Repeat("y", 200000)+"\n\n")
+		io.WriteString(w, "data: {\"after\":\"skipped\"}\n\n")
+		io.WriteString(w, "id: 8\ndata: {\"incomplete\":true}\n")
+	})
+	mux.HandleFunc("/mcp/post", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	unknown := make(chan string, 1)
+	transport := transports.NewSSETransport(ts.URL+"/mcp",
+		transports.WithReconnectPolicy(transports.ReconnectPolicy{InitialDelay: 10 * time.Millisecond, Multiplier: 1}),
+		transports.WithUnknownEventHandler(func(event, data string) {
+			unknown <- event + ":" + data
+		}),
+		transports.WithMaxEventSize(len(big)))
+	defer transport.Close()
+	for _, want := range []struct {
+		msg string
+		err error
+	}{
+		{"{\"jsonrpc\":\"2.0\",\n\"method\":\"split\"}", nil},
+		{big, nil},
+		{"", transports.ErrMessageTooLarge},
+		{`{"after":"skipped"}`, nil},
+	} {
+		msg, err := transport.ReadMessage()
+		if err != want.err {
+			t.Fatalf("got error %v, want %v", err, want.err)
+		}
+		if string(msg) != want.msg {
+			t.Errorf("got message %.50s, want %.50s", msg, want.msg)
+		}
+	}
+	if got := <-unknown; got != "progress:50" {
+		t.Errorf("unknown event handler got %q", got)
+	}
+	if err := transport.WriteMessage(json.RawMessage(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-posted; got != `{}` {
+		t.Errorf("posted %q to the announced endpoint", got)
+	}
+	// The stream ended inside an event, so its ID must not be used.
+	<-lastEventIDs
+	select {
+	case id := <-lastEventIDs:
+		if id != "7" {
+			t.Errorf("reconnected with Last-Event-ID %q, want 7", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transport did not reconnect")
+	}
+}
+
+func TestSSEEndpointFallback(t *testing.T) {
+	posted := make(chan string, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp/events", func(w http.ResponseWriter, r *http.Request) {
+		// The stream announces no endpoint and sends nothing.
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/mcp/request", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posted <- string(body)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	transport := transports.NewSSETransport(ts.URL+"/mcp", transports.WithEndpointTimeout(20*time.Millisecond))
+	defer transport.Close()
+	written := make(chan error, 1)
+	go func() {
+		written <- transport.WriteMessage(json.RawMessage(`{}`))
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteMessage waits for an endpoint that is never announced")
+	}
+	if got := <-posted; got != `{}` {
+		t.Errorf("posted %q to the fallback endpoint", got)
+	}
+}
+
+func TestSSEAuth(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	handler := transports.NewSSEHandler(server)
+	var requestIDs sync.Map
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Tenant") != "acme" {
+			http.Error(w, "missing tenant", http.StatusBadRequest)
+			return
+		}
+		id := r.Header.Get("X-Request-Id")
+		if _, dup := requestIDs.LoadOrStore(id, true); id == "" || dup {
+			http.Error(w, "bad request ID", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer fresh" {
+			http.Error(w, "expired token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	var mu sync.Mutex
+	n, refreshes := 0, 0
+	transport := transports.NewSSETransport(ts.URL,
+		transports.WithHTTPClient(ts.Client()),
+		transports.WithHeader("X-Tenant", "acme"),
+		transports.WithHeaderFunc(func(ctx context.Context) (http.Header, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			n++
+			return http.Header{"X-Request-Id": {fmt.Sprint(n)}}, nil
+		}),
+		transports.WithTokenSource(transports.TokenSourceFunc(func(ctx context.Context, refresh bool) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if refresh {
+				refreshes++
+				return "fresh", nil
+			}
+			if refreshes > 0 {
+				return "fresh", nil
+			}
+			return "stale", nil
+		})))
+	client := NewClient(transport)
+	defer client.Close()
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := client.GetPrompt("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Template != "Hello" {
+		t.Errorf("unexpected prompt: %+v", prompt)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if refreshes != 1 {
+		t.Errorf("token refreshed %d times, want 1", refreshes)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	ts := httptest.NewServer(transports.NewWebSocketHandler(server,
+		transports.WithPingInterval(10*time.Millisecond),
+		transports.WithReadLimit(1024)))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	transport, err := transports.DialWebSocket(context.Background(), url, transports.WithPingInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(transport)
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Outlive a few pings.
+	time.Sleep(50 * time.Millisecond)
+	prompt, err := client.GetPrompt("greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Template != "Hello" {
+		t.Errorf("unexpected prompt: %+v", prompt)
+	}
+
+	// A message over the server's read limit closes the connection with
+	// the matching close code.
+	big, err := transports.DialWebSocket(context.Background(), url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer big.Close()
+	if err := big.WriteMessage(json.RawMessage(`"` + strings.Repeat("x", 2048) + `"`)); err != nil {
+		t.Fatal(err)
+	}
+	var closeErr *transports.WebSocketCloseError
+	if _, err := big.ReadMessage(); !errors.Is(err, transports.ErrMessageTooLarge) || !errors.As(err, &closeErr) || closeErr.Code != transports.CloseMessageTooLarge {
+		t.Errorf("oversized message: got %v", err)
+	}
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("plain GET: got status %d", resp.StatusCode)
+	}
+
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(server.Sessions()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("sessions not torn down after the connections closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Run("origin", func(t *testing.T) {
+		ts := httptest.NewServer(transports.NewWebSocketHandler(server,
+			transports.WithAllowedOrigins("https://app.example.com")))
+		defer ts.Close()
+		url := "ws" + strings.TrimPrefix(ts.URL, "http")
+		for _, tc := range []struct {
+			origin  string
+			allowed bool
+		}{
+			{ts.URL, true},
+			{"https://app.example.com", true},
+			{"https://evil.example.com", false},
+			{"null", false},
+		} {
+			transport, err := transports.DialWebSocket(context.Background(), url, transports.WithDialHeader("Origin", tc.origin))
+			if tc.allowed != (err == nil) {
+				t.Errorf("origin %s: got error %v", tc.origin, err)
+			}
+			if err == nil {
+				transport.Close()
+			}
+		}
+	})
+}
+
+func TestListen(t *testing.T) {
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "greeting", Template: "Hello"})
+	path := filepath.Join(t.TempDir(), "mcp.sock")
+	// A socket file left behind by a crashed daemon is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := transports.Listen("unix", path, transports.WithSocketMode(0600), transports.WithStaleSocketRemoval())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("socket mode %v, want 0600", mode)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- ln.Serve(server)
+	}()
+
+	clients := make([]*Client, 2)
+	for i := range clients {
+		transport, err := transports.Dial(context.Background(), "unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[i] = NewClient(transport)
+		if _, err := clients[i].Initialize(context.Background(), Implementation{Name: fmt.Sprint("client-", i)}, nil); err != nil {
+			t.Fatal(err)
+		}
+		prompt, err := clients[i].GetPrompt("greeting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prompt.Template != "Hello" {
+			t.Errorf("unexpected prompt: %+v", prompt)
+		}
+	}
+	if n := len(server.Sessions()); n != 2 {
+		t.Errorf("got %d sessions, want 2", n)
+	}
+	for _, opts := range [][]transports.ListenOption{
+		{transports.WithStaleSocketRemoval()},
+		{transports.WithStaleSocketRemoval(), transports.WithSocketMode(0600)},
+	} {
+		if _, err := transports.Listen("unix", path, opts...); !errors.Is(err, syscall.EADDRINUSE) {
+			t.Errorf("Listen on the socket of a live listener: got %v", err)
+		}
+	}
+	// The socket was set up in a private directory, which is gone.
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Errorf("unexpected files next to the socket: %v, %v", entries, err)
+	}
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v after Close", err)
+	}
+	if n := len(server.Sessions()); n != 0 {
+		t.Errorf("%d sessions left after Close", n)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+	for _, client := range clients {
+		client.Close()
+	}
+
+	tcp, err := transports.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	go tcp.Serve(server)
+	transport, err := transports.Dial(context.Background(), "tcp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(transport)
+	defer client.Close()
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "tcp-client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// wireRecorder records the messages read from a transport.
+type wireRecorder struct {
+	transports.Transport
+	mu   sync.Mutex
+	read []string
+}
+
+func (r *wireRecorder) ReadMessage() (json.RawMessage, error) {
+	msg, err := r.Transport.ReadMessage()
+	r.mu.Lock()
+	r.read = append(r.read, string(msg))
+	r.mu.Unlock()
+	return msg, err
+}
+
+func TestCompression(t *testing.T) {
+	big := strings.Repeat("x", 10000)
+	server := NewServer()
+	server.RegisterPrompt(Prompt{Name: "big", Template: big})
+	server.RegisterHandler("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return params, nil
+	})
+	server.SetMessageCompression(1000)
+
+	serverTransport, clientTransport := transports.NewInMemoryPair()
+	go server.Serve(serverTransport)
+	wire := &wireRecorder{Transport: clientTransport}
+	client := NewClient(wire, WithMessageCompression(1000))
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := client.GetPrompt("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.Template != big {
+		t.Errorf("got template of %d bytes, want %d", len(prompt.Template), len(big))
+	}
+	if _, err := client.ListPrompts(); err != nil {
+		t.Fatal(err)
+	}
+	wire.mu.Lock()
+	read := wire.read
+	wire.mu.Unlock()
+	if len(read) != 3 || strings.HasPrefix(read[0], `{"compressed"`) || !strings.HasPrefix(read[1], `{"compressed":"gzip"`) || len(read[1]) >= len(big) {
+		t.Errorf("unexpected messages on the wire: %.60q", read)
+	}
+	client.Close()
+
+	var posted sync.Map
+	handler := transports.NewSSEHandler(server, transports.WithCompression(1000))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			posted.Store(r.Header.Get("Content-Encoding"), true)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	client = NewClient(transports.NewSSETransport(ts.URL, transports.WithRequestCompression(1000)))
+	defer client.Close()
+	if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := client.CallRaw("echo", big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != `"`+big+`"` {
+		t.Errorf("echo returned %d bytes, want %d", len(raw), len(big)+2)
+	}
+	if _, ok := posted.Load("gzip"); !ok {
+		t.Error("large request body was not compressed")
+	}
+	if _, ok := posted.Load(""); !ok {
+		t.Error("small request body was compressed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/events", nil)
+	req.Header.Set("Accept-Encoding", "br;q=1, gzip;q=0.5")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if coding := resp.Header.Get("Content-Encoding"); coding != "gzip" {
+		t.Fatalf("event stream Content-Encoding %q, want gzip", coding)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(gz).ReadString('\n')
+	if err != nil || line != "event: endpoint\n" {
+		t.Errorf("read %q, %v from the compressed event stream", line, err)
+	}
+
+	t.Run("streamable", func(t *testing.T) {
+		var posted, responded sync.Map
+		handler := transports.NewStreamableHTTPHandler(server, transports.WithCompression(1000))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				posted.Store(r.Header.Get("Content-Encoding"), true)
+			}
+			handler.ServeHTTP(w, r)
+			if r.Method == http.MethodPost {
+				responded.Store(w.Header().Get("Content-Encoding"), true)
+			}
+		}))
+		defer ts.Close()
+		client := NewClient(transports.NewStreamableHTTPTransport(ts.URL, transports.WithRequestCompression(1000)))
+		defer client.Close()
+		if _, err := client.Initialize(context.Background(), Implementation{Name: "client"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := client.CallRaw("echo", big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(raw) != `"`+big+`"` {
+			t.Errorf("echo returned %d bytes, want %d", len(raw), len(big)+2)
+		}
+		if _, ok := posted.Load("gzip"); !ok {
+			t.Error("large request body was not compressed")
+		}
+		if _, ok := responded.Load("gzip"); !ok {
+			t.Error("response was not compressed")
+		}
+	})
+}
+
+// TestHelperServer is not a real test: TestCommandTransport runs the test
+// binary with GO_MCP_HELPER_SERVER set to serve an MCP server over stdio.
+func TestHelperServer(t *testing.T) {
+	if os.Getenv("GO_MCP_HELPER_SERVER") != "1" {
+		return
+	}
+	server := NewServer()
+	server.RegisterHandler("echo", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		return params, nil
+	})
+	server.RegisterHandler("stderr", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var n int
+		json.Unmarshal(params, &n)
+		_, err := fmt.Fprintln(os.Stderr, strings.Repeat("x", n))
+		return n, err
+	})
+	server.Serve(transports.NewStdioTransport())
+	os.Exit(0)
+}
+
+func TestCommandTransport(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperServer$")
+	cmd.Env = append(os.Environ(), "GO_MCP_HELPER_SERVER=1")
+	transport, err := transports.NewCommandTransport(cmd, transports.WithStderrLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(transport)
+	got, err := Call[string](client, "echo", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+	// Lines too long to log must not break the subprocess's stderr.
+	for range 2 {
+		if _, err := Call[int](client, "stderr", 1<<20); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+	if state := transport.ProcessState(); state == nil || state.ExitCode() != 0 {
+		t.Errorf("unexpected process state: %v", state)
+	}
+
+	t.Run("escalation", func(t *testing.T) {
+		if _, err := exec.LookPath("sleep"); err != nil {
+			t.Skip("sleep not available")
+		}
+		// sleep ignores EOF on stdin, so Close has to terminate it.
+		transport, err := transports.NewCommandTransport(exec.Command("sleep", "30"),
+			transports.WithCloseTimeouts(50*time.Millisecond, time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		err = transport.Close()
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			t.Fatalf("Close returned %v, want *exec.ExitError", err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("Close took %v", d)
+		}
+		if _, err := transport.ReadMessage(); err != io.EOF {
+			t.Errorf("ReadMessage after Close returned %v, want io.EOF", err)
+		}
+	})
+}
+
+// connectTestClient serves server over an in-memory pair and returns a client connected to it.
+func connectTestClient(t *testing.T, server *Server) (*Client, func()) {
+	t.Helper()
+	serverTransport, clientTransport := transports.NewInMemoryPair()
+	done := make(chan struct{})
+	go func() {
+		server.Serve(serverTransport)
+		close(done)
+	}()
+	client := NewClient(clientTransport)
+	return client, func() {
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,80 @@
+package mcp
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+)
+
+// RequestHandler handles a decoded request and returns its result or error.
+type RequestHandler func(ctx context.Context, req *Request) (interface{}, error)
+
+// Middleware wraps request dispatch. It can inspect or modify the request
+// before calling next, inspect or replace the result and error afterwards, or
+// return without calling next at all. The session the request belongs to is
+// available from ctx via SessionFromContext.
+type Middleware func(next RequestHandler) RequestHandler
+
+// Use appends middleware to the chain run for every request, including the
+// built-in prompt, resource and tool methods. Middleware added first runs
+// outermost. Notifications do not go through the chain.
+func (s *Server) Use(middleware ...Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// chain returns the dispatcher wrapped in the registered middleware.
+func (s *Server) chain() RequestHandler {
+	s.mu.Lock()
+	middleware := s.middleware
+	s.mu.Unlock()
+	h := RequestHandler(s.dispatch)
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// ForMethods scopes mw to requests for the given methods. Other requests
+// bypass it.
+func ForMethods(mw Middleware, methods ...string) Middleware {
+	return scoped(mw, func(req *Request) bool {
+		return slices.Contains(methods, req.Method)
+	})
+}
+
+// ForTools scopes mw to "executeTool" requests for the given tools.
+func ForTools(mw Middleware, tools ...string) Middleware {
+	return scoped(mw, func(req *Request) bool {
+		return req.Method == "executeTool" && slices.Contains(tools, targetName(req.Params))
+	})
+}
+
+// ForResources scopes mw to "getResource" requests for the given resources.
+func ForResources(mw Middleware, resources ...string) Middleware {
+	return scoped(mw, func(req *Request) bool {
+		return req.Method == "getResource" && slices.Contains(resources, targetName(req.Params))
+	})
+}
+
+func scoped(mw Middleware, match func(req *Request) bool) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		wrapped := mw(next)
+		return func(ctx context.Context, req *Request) (interface{}, error) {
+			if match(req) {
+				return wrapped(ctx, req)
+			}
+			return next(ctx, req)
+		}
+	}
+}
+
+// targetName extracts the "name" member of tool and resource request params.
+func targetName(params json.RawMessage) string {
+	var p struct {
+		Name string `json:"name"`
+	}
+	json.Unmarshal(params, &p)
+	return p.Name
+}
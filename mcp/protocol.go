@@ -7,7 +7,7 @@ type Request struct {
 	JSONRPC string          `json:"jsonrpc"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params,omitempty"`
-	ID      interface{}     `json:"id"`
+	ID      ID              `json:"id,omitzero"`
 }
 
 // Response represents a JSON-RPC 2.0 response.
@@ -15,7 +15,7 @@ type Response struct {
 	JSONRPC string          `json:"jsonrpc"`
 	Result  json.RawMessage `json:"result,omitempty"`
 	Error   *RPCError       `json:"error,omitempty"`
-	ID      interface{}     `json:"id"`
+	ID      ID              `json:"id"`
 }
 
 // Notification represents a JSON-RPC 2.0 notification (no ID).
@@ -31,3 +31,35 @@ type RPCError struct {
 	Message string      `json:"message"`
 	Data    interface{} `json:"data,omitempty"`
 }
+
+// LatestProtocolVersion is the newest MCP protocol version the SDK speaks.
+const LatestProtocolVersion = "2025-03-26"
+
+// SupportedProtocolVersions lists the protocol versions the server accepts
+// during initialize. Clients asking for another version are offered
+// LatestProtocolVersion.
+var SupportedProtocolVersions = []string{"2024-11-05", "2025-03-26"}
+
+// Implementation identifies a client or server implementation.
+type Implementation struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// Capabilities describes the optional features a client or server supports,
+// keyed by feature name.
+type Capabilities map[string]interface{}
+
+// InitializeParams are the params of the "initialize" request.
+type InitializeParams struct {
+	ProtocolVersion string         `json:"protocolVersion"`
+	Capabilities    Capabilities   `json:"capabilities"`
+	ClientInfo      Implementation `json:"clientInfo"`
+}
+
+// InitializeResult is the result of the "initialize" request.
+type InitializeResult struct {
+	ProtocolVersion string         `json:"protocolVersion"`
+	Capabilities    Capabilities   `json:"capabilities"`
+	ServerInfo      Implementation `json:"serverInfo"`
+}
@@ -0,0 +1,102 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
+)
+
+// ErrTransportClosed is returned by Run when the transport reached EOF, e.g.
+// because the host closed the server's stdin.
+var ErrTransportClosed = errors.New("mcp: transport closed")
+
+// SignalError is returned by Run when it stopped because of a signal.
+type SignalError struct {
+	Signal os.Signal
+}
+
+// Error implements the error interface.
+func (e *SignalError) Error() string {
+	return "mcp: received signal " + e.Signal.String()
+}
+
+// RunOption configures Run.
+type RunOption func(*runConfig)
+
+type runConfig struct {
+	shutdownTimeout time.Duration
+	signals         []os.Signal
+}
+
+// WithShutdownTimeout sets how long Run waits for in-flight requests before
+// cancelling them. The default is 10 seconds.
+func WithShutdownTimeout(d time.Duration) RunOption {
+	return func(c *runConfig) {
+		c.shutdownTimeout = d
+	}
+}
+
+// WithSignals sets the signals that trigger a graceful shutdown. The default
+// is SIGINT and SIGTERM.
+func WithSignals(signals ...os.Signal) RunOption {
+	return func(c *runConfig) {
+		c.signals = signals
+	}
+}
+
+// Run serves server over transport until the transport reaches EOF, a signal
+// arrives or ctx is done, then shuts the server down gracefully so that
+// in-flight results are still delivered. It returns the reason it stopped:
+// ErrTransportClosed, a *SignalError, ctx's error, or the error that made
+// Serve or Shutdown fail.
+func Run(ctx context.Context, server *Server, transport transports.Transport, opts ...RunOption) error {
+	cfg := runConfig{
+		shutdownTimeout: 10 * time.Second,
+		signals:         []os.Signal{os.Interrupt, syscall.SIGTERM},
+	}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	sigs := make(chan os.Signal, 1)
+	if len(cfg.signals) > 0 {
+		signal.Notify(sigs, cfg.signals...)
+		defer signal.Stop(sigs)
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(transport)
+	}()
+	var reason error
+	serving := true
+	select {
+	case err := <-served:
+		serving = false
+		if err == nil {
+			reason = ErrTransportClosed
+		} else {
+			reason = err
+		}
+	case sig := <-sigs:
+		reason = &SignalError{Signal: sig}
+	case <-ctx.Done():
+		reason = ctx.Err()
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if serving {
+		<-served
+	}
+	if err != nil && err != ErrServerClosed {
+		return fmt.Errorf("%w (shutdown: %w)", reason, err)
+	}
+	return reason
+}
@@ -1,27 +1,55 @@
 package mcp
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"runtime/debug"
 	"sync"
+	"time"
 
 	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
 )
 
 // Server handles MCP server-side logic, processing requests and sending responses/notifications.
 type Server struct {
-	handlers         map[string]HandlerFunc
-	prompts          map[string]Prompt
-	resourceHandlers map[string]Handler
-	toolHandlers     map[string]Handler
-	onStart          func() error
-	onStop           func() error
-	transport        transports.Transport
-	mu               sync.Mutex
+	handlers             map[string]HandlerFunc
+	notificationHandlers map[string]ServerNotificationHandler
+	middleware           []Middleware
+	prompts              map[string]Prompt
+	resourceHandlers     map[string]Handler
+	toolHandlers         map[string]*toolEntry
+	onStart              func() error
+	onStop               func() error
+	onPanic              func(PanicInfo)
+	onTimeout            func(TimeoutInfo)
+	defaultTimeout       time.Duration
+	timeoutGrace         time.Duration
+	panicStackInErrors   bool
+	info                 Implementation
+	limits               ConcurrencyLimits
+	compress             bool
+	compressThreshold    int
+	globalLimiter        *limiter
+	sessions             map[*Session]struct{}
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	closing              bool
+	active               int
+	idle                 chan struct{}
+	done                 chan struct{}
+	started              bool
+	startMu              sync.Mutex
+	mu                   sync.Mutex
 }
 
+// Server can be served by the HTTP transports' handlers.
+var _ transports.Server = (*Server)(nil)
+
 // Handler defines the interface for handling JSON-RPC requests.
 type Handler interface {
 	ServeJSONRPC(ctx context.Context, params json.RawMessage) (interface{}, error)
@@ -30,20 +58,34 @@ type Handler interface {
 // HandlerFunc is a function type for handling JSON-RPC requests.
 type HandlerFunc func(ctx context.Context, params json.RawMessage) (interface{}, error)
 
+// ServerNotificationHandler handles a notification sent by a client. Like a
+// request handler, it receives a context carrying the client's session.
+type ServerNotificationHandler func(ctx context.Context, method string, params json.RawMessage) error
+
 // ServeJSONRPC implements the Handler interface for HandlerFunc.
 func (f HandlerFunc) ServeJSONRPC(ctx context.Context, params json.RawMessage) (interface{}, error) {
 	return f(ctx, params)
 }
 
+// PanicInfo describes a panic recovered while handling a request or notification.
+type PanicInfo struct {
+	Method string
+	ID     ID // absent for notifications
+	Value  interface{}
+	Stack  []byte
+}
+
 // Prompt represents an MCP prompt template.
 type Prompt struct {
 	Name     string
 	Template string
 }
 
-// Resource defines a generic resource handler.
+// Resource defines a generic resource handler. HandlerContext, if set, is
+// used instead of Handler and receives the request's context.
 type Resource[Req, Resp any] struct {
-	Handler func(Req) (Resp, error)
+	Handler        func(Req) (Resp, error)
+	HandlerContext func(context.Context, Req) (Resp, error)
 }
 
 // ServeJSONRPC implements the Handler interface for Resource.
@@ -61,12 +103,18 @@ func (r Resource[Req, Resp]) ServeJSONRPC(ctx context.Context, params json.RawMe
 			return nil, err
 		}
 	}
+	if r.HandlerContext != nil {
+		return r.HandlerContext(ctx, p)
+	}
 	return r.Handler(p)
 }
 
-// Tool defines a generic tool handler.
+// Tool defines a generic tool handler. ExecuteContext, if set, is used
+// instead of Execute and receives the request's context, which is cancelled
+// when the call times out or the client cancels it.
 type Tool[Req, Resp any] struct {
-	Execute func(Req) (Resp, error)
+	Execute        func(Req) (Resp, error)
+	ExecuteContext func(context.Context, Req) (Resp, error)
 }
 
 // ServeJSONRPC implements the Handler interface for Tool.
@@ -82,6 +130,9 @@ func (t Tool[Req, Resp]) ServeJSONRPC(ctx context.Context, params json.RawMessag
 	if err := json.Unmarshal(req.Params, &p); err != nil {
 		return nil, err
 	}
+	if t.ExecuteContext != nil {
+		return t.ExecuteContext(ctx, p)
+	}
 	return t.Execute(p)
 }
 
@@ -90,19 +141,38 @@ func NewResource[Req, Resp any](handler func(Req) (Resp, error)) Handler {
 	return Resource[Req, Resp]{Handler: handler}
 }
 
+// NewResourceContext creates a new resource handler receiving the request's
+// context.
+func NewResourceContext[Req, Resp any](handler func(context.Context, Req) (Resp, error)) Handler {
+	return Resource[Req, Resp]{HandlerContext: handler}
+}
+
 // NewTool creates a new tool handler.
 func NewTool[Req, Resp any](execute func(Req) (Resp, error)) Handler {
 	return Tool[Req, Resp]{Execute: execute}
 }
 
+// NewToolContext creates a new tool handler receiving the request's context.
+// A tool that may run long should use it and return once the context is
+// done, so that a timed-out call does not keep its concurrency slot.
+func NewToolContext[Req, Resp any](execute func(context.Context, Req) (Resp, error)) Handler {
+	return Tool[Req, Resp]{ExecuteContext: execute}
+}
+
 // NewServer creates a new MCP server instance.
 func NewServer() *Server {
 	s := &Server{
-		handlers:         make(map[string]HandlerFunc),
-		prompts:          make(map[string]Prompt),
-		resourceHandlers: make(map[string]Handler),
-		toolHandlers:     make(map[string]Handler),
+		handlers:             make(map[string]HandlerFunc),
+		notificationHandlers: make(map[string]ServerNotificationHandler),
+		prompts:              make(map[string]Prompt),
+		resourceHandlers:     make(map[string]Handler),
+		toolHandlers:         make(map[string]*toolEntry),
+		sessions:             make(map[*Session]struct{}),
+		done:                 make(chan struct{}),
+		info:                 Implementation{Name: "go-mcp-sdk"},
 	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.handlers["initialize"] = s.initializeHandler()
 	s.handlers["listPrompts"] = s.listPromptsHandler()
 	s.handlers["getPrompt"] = s.getPromptHandler()
 	s.handlers["getResource"] = s.getResourceHandler()
@@ -117,6 +187,15 @@ func (s *Server) RegisterHandler(method string, handler HandlerFunc) {
 	s.handlers[method] = handler
 }
 
+// RegisterNotificationHandler registers a handler for a notification method sent
+// by the client, such as "notifications/initialized". Notifications never
+// receive a response; errors returned by the handler are only logged.
+func (s *Server) RegisterNotificationHandler(method string, handler ServerNotificationHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notificationHandlers[method] = handler
+}
+
 // RegisterResource registers a resource with a specific name.
 func (s *Server) RegisterResource(name string, handler Handler) {
 	s.mu.Lock()
@@ -125,10 +204,14 @@ func (s *Server) RegisterResource(name string, handler Handler) {
 }
 
 // RegisterTool registers a tool with a specific name.
-func (s *Server) RegisterTool(name string, handler Handler) {
+func (s *Server) RegisterTool(name string, handler Handler, opts ...ToolOption) {
+	entry := &toolEntry{handler: handler}
+	for _, opt := range opts {
+		opt(entry)
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.toolHandlers[name] = handler
+	s.toolHandlers[name] = entry
 }
 
 // RegisterPrompt registers a prompt template.
@@ -138,118 +221,392 @@ func (s *Server) RegisterPrompt(prompt Prompt) {
 	s.prompts[prompt.Name] = prompt
 }
 
-// SetOnStart sets the startup hook.
+// SetOnStart sets the startup hook. It runs once, on the first call to Serve,
+// and an error from it makes Serve return that error.
 func (s *Server) SetOnStart(handler func() error) {
 	s.onStart = handler
 }
 
-// SetOnStop sets the shutdown hook.
+// SetOnStop sets the shutdown hook. It runs during Shutdown.
 func (s *Server) SetOnStop(handler func() error) {
 	s.onStop = handler
 }
 
-// SendNotification sends a notification to the client.
-func (s *Server) SendNotification(method string, params interface{}) error {
-	p, err := json.Marshal(params)
-	if err != nil {
+// SetOnPanic sets a hook called with every panic recovered from a handler,
+// e.g. to forward it to crash reporting. The server keeps serving either way.
+func (s *Server) SetOnPanic(handler func(PanicInfo)) {
+	s.onPanic = handler
+}
+
+// SetPanicStackInErrors controls whether the Internal Error sent to the client
+// for a recovered panic carries the panic value and stack trace in its data.
+// It is disabled by default.
+func (s *Server) SetPanicStackInErrors(enabled bool) {
+	s.panicStackInErrors = enabled
+}
+
+// Serve serves a new session over the given transport. Serve can be called
+// concurrently with different transports to serve many clients at once. It
+// returns nil when the transport reaches EOF, after the requests already
+// read have been handled, and ErrServerClosed after Shutdown.
+func (s *Server) Serve(transport transports.Transport) error {
+	if err := s.start(); err != nil {
 		return err
 	}
-	n := Notification{
-		JSONRPC: "2.0",
-		Method:  method,
-		Params:  p,
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
 	}
-	data, err := json.Marshal(n)
-	if err != nil {
-		return err
+	var compressed *transports.CompressedTransport
+	if s.compress {
+		compressed = transports.NewCompressedTransport(transport, s.compressThreshold)
+		transport = compressed
 	}
-	return s.transport.WriteMessage(data)
-}
+	sess := newSession(s, transport, s.limits)
+	sess.compressed = compressed
+	s.sessions[sess] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.sessions, sess)
+		s.mu.Unlock()
+		sess.close()
+	}()
 
-// Serve starts the server with the given transport.
-func (s *Server) Serve(transport transports.Transport) error {
-	s.transport = transport
-	// if s.onStart != nil {
-	// 	if err := s.onStart(); err != nil {
-	// 		return err
-	// 	}
-	// }
-	// defer func() {
-	// 	if s.onStop != nil {
-	// 		s.onStop()
-	// 	}
-	// }()
+	// Read in a separate goroutine so that Serve returns on Shutdown even if
+	// closing the transport does not unblock ReadMessage.
+	type readResult struct {
+		msg json.RawMessage
+		err error
+	}
+	reads := make(chan readResult)
+	go func() {
+		for {
+			msg, err := transport.ReadMessage()
+			select {
+			case reads <- readResult{msg, err}:
+			case <-s.done:
+				return
+			}
+			if err != nil && skippedMessageError(err) == nil {
+				return
+			}
+		}
+	}()
 	for {
-		msg, err := transport.ReadMessage()
-		if err == io.EOF {
-			fmt.Println("Server received EOF, stopping")
-			return nil
+		var r readResult
+		select {
+		case r = <-reads:
+		case <-s.done:
+			return ErrServerClosed
 		}
-		if err != nil {
-			fmt.Println("Server read error:", err)
-			return err
+		if r.err == io.EOF {
+			log.Println("Server received EOF, stopping")
+			drained := make(chan struct{})
+			go func() {
+				sess.wg.Wait()
+				close(drained)
+			}()
+			select {
+			case <-drained:
+				return nil
+			case <-s.done:
+				return ErrServerClosed
+			}
+		}
+		if rpcErr := skippedMessageError(r.err); rpcErr != nil {
+			log.Println("Server skipped message:", r.err)
+			s.writeResponse(sess, errorResponse(NullID(), rpcErr))
+			continue
+		}
+		if r.err != nil {
+			log.Println("Server read error:", r.err)
+			return r.err
+		}
+		if sess.compressed != nil {
+			sess.startCompression(r.msg)
+		}
+		s.admit(s.ctx, r.msg, sess)
+	}
+}
+
+// skippedMessageError returns the error to answer a message the transport
+// could not read with, or nil if err is not about a single message. Only a
+// bare ErrMessageTooLarge means the transport skipped the message; an error
+// merely matching it reports a closed connection.
+func skippedMessageError(err error) *RPCError {
+	switch {
+	case err == transports.ErrMessageTooLarge:
+		return ErrInvalidRequest
+	case errors.Is(err, transports.ErrMalformedMessage):
+		return ErrParseError
+	}
+	return nil
+}
+
+// handleMessage handles a request or notification and writes the response.
+// It returns once handlers that outlived a timeout have returned too.
+func (s *Server) handleMessage(sess *Session, msg json.RawMessage) {
+	var running sync.WaitGroup
+	s.writeResponse(sess, s.handleRequest(sess, msg, &running))
+	running.Wait()
+}
+
+// handleBatch executes the entries of a JSON-RPC batch concurrently and replies
+// with a single array holding the responses in the order of the entries.
+// Each request takes a slot under the concurrency limits like a single one,
+// and its place in the session's queue before handleBatch returns, so that a
+// batch cannot queue more requests than a series of single ones.
+// Notifications produce no response; if nothing is left to send, nothing is written.
+// done is called once handlers that outlived a timeout have returned too.
+func (s *Server) handleBatch(ctx context.Context, sess *Session, msg json.RawMessage, done func()) {
+	limits, limiters := s.limitsFor(sess)
+	var batch []json.RawMessage
+	var rejection *Response
+	if err := json.Unmarshal(msg, &batch); err != nil {
+		log.Println("Server batch unmarshal error:", err)
+		rejection = errorResponse(NullID(), ErrParseError)
+	} else if len(batch) == 0 || len(batch) > limits.batchSize() {
+		rejection = errorResponse(NullID(), ErrInvalidRequest)
+	}
+	if rejection != nil {
+		go func() {
+			defer done()
+			s.writeResponse(sess, rejection)
+		}()
+		return
+	}
+	responses := make([]*Response, len(batch))
+	// answered is done once every entry has its response, finished once the
+	// handlers of every entry have returned and released their slots.
+	var answered, finished sync.WaitGroup
+	for i, entry := range batch {
+		answered.Add(1)
+		finished.Add(1)
+		request := !isNotification(entry)
+		var err error
+		if request {
+			err = sess.enqueue(ctx)
 		}
-		fmt.Println("Server received message:", string(msg))
-		go s.handleMessage(msg)
+		go func() {
+			defer finished.Done()
+			if request {
+				var release func()
+				if err == nil {
+					release, err = acquire(ctx, limiters, nil, limits)
+					sess.queue.release()
+				}
+				if err != nil {
+					var req Request
+					json.Unmarshal(entry, &req)
+					if req.ID.IsAbsent() {
+						req.ID = NullID()
+					}
+					responses[i] = errorResponse(req.ID, toRPCError(err))
+					answered.Done()
+					return
+				}
+				defer release()
+			}
+			var running sync.WaitGroup
+			defer running.Wait()
+			responses[i] = s.handleRequest(sess, entry, &running)
+			answered.Done()
+		}()
 	}
+	go func() {
+		defer done()
+		defer finished.Wait()
+		answered.Wait()
+		out := make([]*Response, 0, len(responses))
+		for _, resp := range responses {
+			if resp != nil {
+				out = append(out, resp)
+			}
+		}
+		if len(out) == 0 {
+			return
+		}
+		data, err := json.Marshal(out)
+		if err != nil {
+			log.Println("Error marshaling batch response:", err)
+			return
+		}
+		sess.transport.WriteMessage(data)
+	}()
 }
 
-func (s *Server) handleMessage(msg json.RawMessage) {
+// handleRequest dispatches a single request to its handler and builds the response.
+// It returns nil for notifications and for requests cancelled by the client.
+// A panic in a handler is turned into an Internal Error response. Handlers
+// still running after their request timed out are added to running.
+func (s *Server) handleRequest(sess *Session, msg json.RawMessage, running *sync.WaitGroup) (resp *Response) {
 	var req Request
 	if err := json.Unmarshal(msg, &req); err != nil {
-		fmt.Println("Server unmarshal error:", err)
-		s.sendError(nil, -32700, "Parse error", nil)
-		return
+		log.Println("Server unmarshal error:", err)
+		if json.Valid(msg) {
+			return errorResponse(NullID(), ErrInvalidRequest)
+		}
+		return errorResponse(NullID(), ErrParseError)
 	}
-	fmt.Println("Server processing request:", req.Method, "ID:", req.ID)
-	if req.JSONRPC != "2.0" {
-		s.sendError(req.ID, -32600, "Invalid Request", nil)
-		return
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		if req.ID.IsAbsent() {
+			return errorResponse(NullID(), ErrInvalidRequest)
+		}
+		return errorResponse(req.ID, ErrInvalidRequest)
 	}
-	handler, ok := s.handlers[req.Method]
-	if !ok {
-		s.sendError(req.ID, -32601, "Method not found", nil)
-		return
+	defer func() {
+		if r := recover(); r != nil {
+			resp = s.recoverPanic(req, r)
+		}
+	}()
+	if req.ID.IsAbsent() {
+		s.handleNotification(sess, req)
+		return nil
 	}
-	ctx := context.Background()
-	result, err := handler(ctx, req.Params)
-	resp := Response{
+	ctx := context.WithValue(context.WithValue(s.ctx, sessionKey{}, sess), runningKey{}, running)
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	sess.mu.Lock()
+	sess.inflight[req.ID] = cancel
+	sess.mu.Unlock()
+	defer func() {
+		sess.mu.Lock()
+		delete(sess.inflight, req.ID)
+		sess.mu.Unlock()
+	}()
+	result, err := s.chain()(ctx, &req)
+	if context.Cause(ctx) == errRequestCancelled {
+		return nil
+	}
+	resp = &Response{
 		JSONRPC: "2.0",
 		ID:      req.ID,
 	}
 	if err != nil {
-		resp.Error = &RPCError{
-			Code:    -32000,
-			Message: err.Error(),
-		}
+		resp.Error = toRPCError(err)
 	} else if result != nil {
-		resp.Result, _ = json.Marshal(result)
+		resp.Result, err = json.Marshal(result)
+		if err != nil {
+			log.Println("Error marshaling result:", err)
+			return errorResponse(req.ID, ErrInternalError)
+		}
+	}
+	return resp
+}
+
+// dispatch looks up the handler registered for req.Method and runs it. It is
+// the innermost handler of the middleware chain.
+func (s *Server) dispatch(ctx context.Context, req *Request) (interface{}, error) {
+	s.mu.Lock()
+	handler, ok := s.handlers[req.Method]
+	s.mu.Unlock()
+	if !ok {
+		return nil, NewMethodNotFoundError("", req.Method)
+	}
+	return s.callWithTimeout(ctx, req, func(ctx context.Context) (interface{}, error) {
+		return handler(ctx, req.Params)
+	})
+}
+
+// recoverPanic reports a panic recovered while handling req and returns the
+// Internal Error response to send, or nil if req is a notification.
+func (s *Server) recoverPanic(req Request, value interface{}) *Response {
+	info := s.reportPanic(req, value)
+	if req.ID.IsAbsent() {
+		return nil
+	}
+	var data interface{}
+	if s.panicStackInErrors {
+		data = map[string]string{
+			"panic": fmt.Sprint(info.Value),
+			"stack": string(info.Stack),
+		}
+	}
+	return errorResponse(req.ID, NewInternalError("", data))
+}
+
+// reportPanic logs a panic recovered while handling req and passes it to the
+// panic hook.
+func (s *Server) reportPanic(req Request, value interface{}) PanicInfo {
+	info := PanicInfo{
+		Method: req.Method,
+		ID:     req.ID,
+		Value:  value,
+		Stack:  debug.Stack(),
+	}
+	if p, ok := value.(*handlerPanic); ok {
+		info.Value, info.Stack = p.value, p.stack
+	}
+	log.Println("Server recovered panic in", req.Method, "ID:", req.ID, ":", info.Value)
+	if s.onPanic != nil {
+		s.onPanic(info)
+	}
+	return info
+}
+
+// errRequestCancelled is the cancellation cause of requests cancelled by a
+// "notifications/cancelled" notification.
+var errRequestCancelled = errors.New("request cancelled by client")
+
+// handleNotification runs the handler registered for a notification. Unknown
+// notifications are ignored. "notifications/cancelled" additionally cancels
+// the context of the referenced in-flight request, whose response is then
+// never sent.
+func (s *Server) handleNotification(sess *Session, req Request) {
+	if req.Method == "notifications/cancelled" {
+		var p struct {
+			RequestID ID     `json:"requestId"`
+			Reason    string `json:"reason,omitempty"`
+		}
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			log.Println("Server cancelled notification unmarshal error:", err)
+		} else {
+			sess.mu.Lock()
+			cancel, ok := sess.inflight[p.RequestID]
+			sess.mu.Unlock()
+			if ok {
+				cancel(errRequestCancelled)
+			}
+		}
+	}
+	s.mu.Lock()
+	handler, ok := s.notificationHandlers[req.Method]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	ctx := context.WithValue(s.ctx, sessionKey{}, sess)
+	if err := handler(ctx, req.Method, req.Params); err != nil {
+		log.Println("Server notification handler error:", req.Method, err)
+	}
+}
+
+func (s *Server) writeResponse(sess *Session, resp *Response) {
+	if resp == nil {
+		return
 	}
-	// data, _ := json.Marshal(resp)
 	data, err := json.Marshal(resp)
 	if err != nil {
-		fmt.Println("Error marchaling response:", err)
+		log.Println("Error marshaling response:", err)
 		return
 	}
-	s.transport.WriteMessage(data)
+	sess.transport.WriteMessage(data)
 }
 
-func (s *Server) sendError(id interface{}, code int, message string, errorData interface{}) {
-	resp := Response{
+func errorResponse(id ID, rpcErr *RPCError) *Response {
+	return &Response{
 		JSONRPC: "2.0",
 		ID:      id,
-		Error: &RPCError{
-			Code:    code,
-			Message: message,
-			Data:    errorData,
-		},
-	}
-	data, err := json.Marshal(resp) // Use = instead of := if data is already declared, or handle properly
-	if err != nil {
-		fmt.Println("Error marshaling error response:", err)
-		return
+		Error:   rpcErr,
 	}
-	s.transport.WriteMessage(data)
+}
+
+// isBatch reports whether msg is a JSON array, i.e. a JSON-RPC batch.
+func isBatch(msg json.RawMessage) bool {
+	trimmed := bytes.TrimLeft(msg, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
 }
 
 // listPromptsHandler returns a handler for the "listPrompts" method.
@@ -274,7 +631,7 @@ func (s *Server) getPromptHandler() HandlerFunc {
 		defer s.mu.Unlock()
 		prompt, ok := s.prompts[p.Name]
 		if !ok {
-			return nil, fmt.Errorf("prompt not found: %s", p.Name)
+			return nil, NewInvalidParamsError(fmt.Sprintf("prompt not found: %s", p.Name), nil)
 		}
 		return prompt, nil
 	}
@@ -293,7 +650,7 @@ func (s *Server) getResourceHandler() HandlerFunc {
 		handler, ok := s.resourceHandlers[p.Name]
 		s.mu.Unlock()
 		if !ok {
-			return nil, fmt.Errorf("resource not found: %s", p.Name)
+			return nil, NewResourceNotFoundError(fmt.Sprintf("resource not found: %s", p.Name), map[string]string{"name": p.Name})
 		}
 		return handler.ServeJSONRPC(ctx, params)
 	}
@@ -309,11 +666,17 @@ func (s *Server) executeToolHandler() HandlerFunc {
 			return nil, err
 		}
 		s.mu.Lock()
-		handler, ok := s.toolHandlers[p.Name]
+		tool, ok := s.toolHandlers[p.Name]
+		limits := s.limits
 		s.mu.Unlock()
 		if !ok {
-			return nil, fmt.Errorf("tool not found: %s", p.Name)
+			return nil, NewInvalidParamsError(fmt.Sprintf("tool not found: %s", p.Name), nil)
 		}
-		return handler.ServeJSONRPC(ctx, params)
+		release, err := acquire(ctx, []*limiter{tool.limiter}, nil, limits)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		return tool.handler.ServeJSONRPC(ctx, params)
 	}
 }
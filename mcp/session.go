@@ -0,0 +1,256 @@
+package mcp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/reinhardt-bit/go-mcp-sdk/mcp/transports"
+)
+
+// Session is a single client connection served by Serve. A Server can have
+// many sessions at once; each has its own transport, in-flight requests,
+// negotiated capabilities and state.
+type Session struct {
+	id        string
+	server    *Server
+	transport transports.Transport
+	limiter   *limiter
+	// queue holds a place for each request waiting for its slots under
+	// QueueBlock.
+	queue *limiter
+	wg    sync.WaitGroup
+	// compressed is the transport wrapper compressing messages, if the
+	// server has compression enabled.
+	compressed *transports.CompressedTransport
+
+	mu              sync.Mutex
+	inflight        map[ID]context.CancelCauseFunc
+	protocolVersion string
+	clientInfo      Implementation
+	clientCaps      Capabilities
+	encoding        string
+	values          map[interface{}]interface{}
+	onClose         []func()
+	closed          bool
+}
+
+type sessionKey struct{}
+
+// SessionFromContext returns the session a request or notification is being
+// handled for, or nil if ctx does not belong to one.
+func SessionFromContext(ctx context.Context) *Session {
+	s, _ := ctx.Value(sessionKey{}).(*Session)
+	return s
+}
+
+func newSession(server *Server, transport transports.Transport, limits ConcurrencyLimits) *Session {
+	var b [16]byte
+	rand.Read(b[:])
+	return &Session{
+		id:        hex.EncodeToString(b[:]),
+		server:    server,
+		transport: transport,
+		limiter:   newLimiter(limits.MaxInFlightPerSession),
+		queue:     newLimiter(limits.sessionQueue()),
+		inflight:  make(map[ID]context.CancelCauseFunc),
+		values:    make(map[interface{}]interface{}),
+	}
+}
+
+// ID returns the unique, randomly generated id of the session.
+func (s *Session) ID() string {
+	return s.id
+}
+
+// ProtocolVersion returns the protocol version negotiated during initialize,
+// or "" if the client has not initialized yet.
+func (s *Session) ProtocolVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.protocolVersion
+}
+
+// ClientInfo returns the client implementation sent during initialize.
+func (s *Session) ClientInfo() Implementation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientInfo
+}
+
+// ClientCapabilities returns the capabilities the client sent during initialize.
+func (s *Session) ClientCapabilities() Capabilities {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientCaps
+}
+
+// OnClose registers f to be called when the session ends, i.e. when Serve
+// returns. Callbacks run in reverse order of registration. If the session
+// has already ended, f is called immediately.
+func (s *Session) OnClose(f func()) {
+	s.mu.Lock()
+	if !s.closed {
+		s.onClose = append(s.onClose, f)
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	f()
+}
+
+// close ends the session, running the OnClose callbacks and dropping the
+// stored values.
+func (s *Session) close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	onClose := s.onClose
+	s.onClose = nil
+	s.values = make(map[interface{}]interface{})
+	s.mu.Unlock()
+	for i := len(onClose) - 1; i >= 0; i-- {
+		onClose[i]()
+	}
+}
+
+// Get returns the value stored in the session under key.
+func (s *Session) Get(key interface{}) (interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.values[key]
+	return v, ok
+}
+
+// Set stores a value in the session under key. The value lives as long as
+// the session.
+func (s *Session) Set(key, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
+
+// Delete removes the value stored under key.
+func (s *Session) Delete(key interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values, key)
+}
+
+// SendNotification sends a notification to this session's client.
+func (s *Session) SendNotification(method string, params interface{}) error {
+	if !s.server.beginWork(false) {
+		return ErrServerClosed
+	}
+	defer s.server.endWork()
+	n := Notification{
+		JSONRPC: "2.0",
+		Method:  method,
+	}
+	if params != nil {
+		p, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		n.Params = p
+	}
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return s.transport.WriteMessage(data)
+}
+
+// Sessions returns the sessions currently being served.
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for sess := range s.sessions {
+		sessions = append(sessions, sess)
+	}
+	return sessions
+}
+
+// BroadcastNotification sends a notification to every session. It attempts
+// all sessions and returns the errors of those that failed.
+func (s *Server) BroadcastNotification(method string, params interface{}) error {
+	var errs []error
+	for _, sess := range s.Sessions() {
+		if err := sess.SendNotification(method, params); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SendNotification sends a notification to every session.
+//
+// Deprecated: Use BroadcastNotification, or Session.SendNotification to
+// notify a single client.
+func (s *Server) SendNotification(method string, params interface{}) error {
+	return s.BroadcastNotification(method, params)
+}
+
+// initializeHandler returns a handler for the "initialize" method. It records
+// the client's information on the session and answers with the server's.
+func (s *Server) initializeHandler() HandlerFunc {
+	return func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var p InitializeParams
+		if len(params) > 0 {
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, err
+			}
+		}
+		version := LatestProtocolVersion
+		for _, v := range SupportedProtocolVersions {
+			if v == p.ProtocolVersion {
+				version = v
+			}
+		}
+		caps := Capabilities{}
+		if sess := SessionFromContext(ctx); sess != nil {
+			sess.mu.Lock()
+			sess.protocolVersion = version
+			sess.clientInfo = p.ClientInfo
+			sess.clientCaps = p.Capabilities
+			if sess.compressed != nil {
+				sess.encoding = chooseEncoding(p.Capabilities)
+			}
+			if sess.encoding != "" {
+				caps = withExperimentalCapability(caps, compressionCapability, map[string]interface{}{"encoding": sess.encoding})
+			}
+			sess.mu.Unlock()
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.prompts) > 0 {
+			caps["prompts"] = map[string]interface{}{}
+		}
+		if len(s.resourceHandlers) > 0 {
+			caps["resources"] = map[string]interface{}{}
+		}
+		if len(s.toolHandlers) > 0 {
+			caps["tools"] = map[string]interface{}{}
+		}
+		return InitializeResult{
+			ProtocolVersion: version,
+			Capabilities:    caps,
+			ServerInfo:      s.info,
+		}, nil
+	}
+}
+
+// SetServerInfo sets the implementation name and version reported to clients
+// during initialize.
+func (s *Server) SetServerInfo(name, version string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info = Implementation{Name: name, Version: version}
+}
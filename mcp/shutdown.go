@@ -0,0 +1,117 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrServerClosed is returned by Serve and SendNotification once the server
+// has been shut down.
+var ErrServerClosed = errors.New("mcp: server closed")
+
+// errShuttingDown answers requests that arrive while the server drains.
+var errShuttingDown = NewRPCError(CodeServerBusy, "Server shutting down", nil)
+
+// Shutdown gracefully stops the server. It stops accepting new requests
+// (they are answered with an error while in-flight work drains), waits for
+// in-flight handlers and notifications to finish, runs the OnStop hook if
+// OnStart ran, and closes the transports of all sessions, which
+// then return ErrServerClosed.
+//
+// If ctx is done before the in-flight handlers finish, their contexts are
+// cancelled and Shutdown proceeds without waiting further, returning the
+// context's error. Calling Shutdown more than once returns ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.closing = true
+	idle := make(chan struct{})
+	if s.active == 0 {
+		close(idle)
+	} else {
+		s.idle = idle
+	}
+	s.mu.Unlock()
+
+	var err error
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		s.cancel()
+		err = ctx.Err()
+	}
+	s.startMu.Lock()
+	started := s.started
+	s.startMu.Unlock()
+	if started && s.onStop != nil {
+		if stopErr := s.onStop(); err == nil {
+			err = stopErr
+		}
+	}
+	close(s.done)
+
+	for _, sess := range s.Sessions() {
+		if closeErr := sess.transport.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// start runs the OnStart hook the first time the server is served. If the
+// hook fails, the next call to Serve runs it again.
+func (s *Server) start() error {
+	s.startMu.Lock()
+	defer s.startMu.Unlock()
+	if s.started {
+		return nil
+	}
+	if s.onStart != nil {
+		if err := s.onStart(); err != nil {
+			return err
+		}
+	}
+	s.started = true
+	return nil
+}
+
+// beginWork registers in-flight work that Shutdown waits for. It reports
+// false if the server is closed. While Shutdown drains, new requests are
+// refused, but other work such as notifications is admitted as long as
+// Shutdown still waits for in-flight work, so that handlers can report
+// progress and clients cancel requests.
+func (s *Server) beginWork(request bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.done:
+		return false
+	default:
+	}
+	if s.closing && (request || s.active == 0) {
+		return false
+	}
+	s.active++
+	return true
+}
+
+// endWork marks work registered with beginWork as finished.
+func (s *Server) endWork() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active--
+	if s.active == 0 && s.idle != nil {
+		close(s.idle)
+		s.idle = nil
+	}
+}
+
+// isClosing reports whether Shutdown has been called.
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
@@ -0,0 +1,61 @@
+package mcp
+
+import "context"
+
+// Key is a typed key for values stored in a Session. Each call to NewKey
+// returns a distinct key, so packages can't clash even if they use the same
+// name.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey returns a new key for values of type T. The name is only used for
+// debugging.
+func NewKey[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+// String returns the name of the key.
+func (k *Key[T]) String() string {
+	return k.name
+}
+
+// Get returns the value stored under k in sess. It reports false if there
+// is none, or if a value of another type was stored under k with
+// Session.Set.
+func (k *Key[T]) Get(sess *Session) (T, bool) {
+	v, _ := sess.Get(k)
+	t, ok := v.(T)
+	return t, ok
+}
+
+// Set stores value under k in sess.
+func (k *Key[T]) Set(sess *Session, value T) {
+	sess.Set(k, value)
+}
+
+// Delete removes the value stored under k in sess.
+func (k *Key[T]) Delete(sess *Session) {
+	sess.Delete(k)
+}
+
+// Value returns the value stored under k in the session of the request
+// being handled with ctx.
+func (k *Key[T]) Value(ctx context.Context) (T, bool) {
+	sess := SessionFromContext(ctx)
+	if sess == nil {
+		return *new(T), false
+	}
+	return k.Get(sess)
+}
+
+// SetValue stores value under k in the session of the request being handled
+// with ctx. It reports false if ctx does not belong to a request.
+func (k *Key[T]) SetValue(ctx context.Context, value T) bool {
+	sess := SessionFromContext(ctx)
+	if sess == nil {
+		return false
+	}
+	k.Set(sess, value)
+	return true
+}
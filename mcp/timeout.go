@@ -0,0 +1,167 @@
+package mcp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// TimeoutInfo describes a request that exceeded its timeout.
+type TimeoutInfo struct {
+	Method  string
+	ID      ID
+	Tool    string // set for "executeTool" requests
+	Timeout time.Duration
+}
+
+// SetDefaultTimeout sets the time limit for handling a request. Tools can
+// override it with WithTimeout. Zero, the default, means no limit.
+func (s *Server) SetDefaultTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.defaultTimeout = d
+}
+
+// SetTimeoutGracePeriod sets how long a handler may keep running after its
+// context was cancelled for exceeding the timeout. A handler returning a
+// result within the grace period has that result sent; otherwise the client
+// receives ErrRequestTimeout. With no grace period the timeout error is sent
+// as soon as the deadline passes. A handler still running then keeps its
+// slot under the concurrency limits, and Shutdown waits for it, until it
+// returns.
+func (s *Server) SetTimeoutGracePeriod(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeoutGrace = d
+}
+
+// SetOnTimeout sets a hook called for every request that times out, e.g. to
+// record a metric.
+func (s *Server) SetOnTimeout(handler func(TimeoutInfo)) {
+	s.onTimeout = handler
+}
+
+// WithTimeout sets the time limit for calls of the tool, overriding the
+// server's default timeout.
+func WithTimeout(d time.Duration) ToolOption {
+	return func(t *toolEntry) {
+		t.timeout = d
+	}
+}
+
+// errRequestTimeout is the cancellation cause of requests that exceeded their timeout.
+var errRequestTimeout = errors.New("request timed out")
+
+// handlerPanic carries a panic from a handler goroutine back to the goroutine
+// handling the request, together with the stack where it happened.
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// runningKey is the context key of the WaitGroup tracking the handlers of a
+// request that keep running after it timed out.
+type runningKey struct{}
+
+// detach records that the handler goroutine closing done keeps running after
+// its request timed out, and calls finished once it returns.
+func detach(ctx context.Context, done <-chan struct{}, finished func()) {
+	running, _ := ctx.Value(runningKey{}).(*sync.WaitGroup)
+	if running != nil {
+		running.Add(1)
+	}
+	go func() {
+		<-done
+		finished()
+		if running != nil {
+			running.Done()
+		}
+	}()
+}
+
+// callWithTimeout runs call under the timeout that applies to req. If the
+// timeout error is returned while call is still running, call is detached
+// from the request; see detach. A panic in a detached call is reported to
+// the panic hook, as no response is left to carry it.
+func (s *Server) callWithTimeout(ctx context.Context, req *Request, call func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	info := TimeoutInfo{Method: req.Method, ID: req.ID}
+	s.mu.Lock()
+	info.Timeout = s.defaultTimeout
+	grace := s.timeoutGrace
+	if req.Method == "executeTool" {
+		info.Tool = targetName(req.Params)
+		if tool, ok := s.toolHandlers[info.Tool]; ok && tool.timeout > 0 {
+			info.Timeout = tool.timeout
+		}
+	}
+	s.mu.Unlock()
+	if info.Timeout <= 0 {
+		return call(ctx)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, info.Timeout, errRequestTimeout)
+	defer cancel()
+	var (
+		result interface{}
+		err    error
+		panicV *handlerPanic
+	)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer func() {
+			if r := recover(); r != nil {
+				panicV = &handlerPanic{value: r, stack: debug.Stack()}
+			}
+		}()
+		result, err = call(ctx)
+	}()
+	// reportDetached runs once a detached call returned.
+	reportDetached := func() {
+		if panicV != nil {
+			s.reportPanic(*req, panicV)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if context.Cause(ctx) != errRequestTimeout {
+			// Cancelled for another reason, e.g. by the client; the handler
+			// is expected to return promptly.
+			<-done
+			break
+		}
+		if grace <= 0 {
+			detach(ctx, done, reportDetached)
+			return nil, s.timedOut(info)
+		}
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+			detach(ctx, done, reportDetached)
+			return nil, s.timedOut(info)
+		}
+	}
+	if panicV != nil {
+		panic(panicV)
+	}
+	if context.Cause(ctx) == errRequestTimeout && err != nil {
+		return nil, s.timedOut(info)
+	}
+	return result, err
+}
+
+// timedOut reports a timeout and returns the error sent to the client.
+func (s *Server) timedOut(info TimeoutInfo) error {
+	log.Println("Server request timed out:", info.Method, "ID:", info.ID, "after", info.Timeout)
+	if s.onTimeout != nil {
+		s.onTimeout(info)
+	}
+	return NewRequestTimeoutError("", map[string]int64{"timeoutMs": info.Timeout.Milliseconds()})
+}
@@ -0,0 +1,189 @@
+package transports
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// CommandTransport implements the Transport interface by launching a server
+// as a subprocess and talking to it over its stdin and stdout.
+type CommandTransport struct {
+	cmd         *exec.Cmd
+	stream      *StreamTransport
+	stdin       *os.File
+	logger      *log.Logger
+	termTimeout time.Duration
+	killTimeout time.Duration
+	stderrDone  chan struct{}
+	exited      chan struct{}
+	waitErr     error
+	closeOnce   sync.Once
+	closeErr    error
+}
+
+// CommandOption configures a CommandTransport.
+type CommandOption func(*CommandTransport)
+
+// WithStderrLogger sets the logger the subprocess's stderr is forwarded to,
+// one line at a time. The default is the standard logger; nil discards it.
+func WithStderrLogger(logger *log.Logger) CommandOption {
+	return func(t *CommandTransport) {
+		t.logger = logger
+	}
+}
+
+// WithCloseTimeouts sets how long Close waits for the subprocess to exit
+// after closing its stdin before sending SIGTERM, and after SIGTERM before
+// killing it. Both default to 5 seconds.
+func WithCloseTimeouts(term, kill time.Duration) CommandOption {
+	return func(t *CommandTransport) {
+		t.termTimeout = term
+		t.killTimeout = kill
+	}
+}
+
+// NewCommandTransport starts cmd and returns a transport connected to it.
+// Configure the program's arguments, environment and working directory on
+// cmd; its Stdin, Stdout and Stderr must be unset.
+func NewCommandTransport(cmd *exec.Cmd, opts ...CommandOption) (*CommandTransport, error) {
+	if cmd.Stdin != nil || cmd.Stdout != nil || cmd.Stderr != nil {
+		return nil, errors.New("transports: command Stdin, Stdout and Stderr must be unset")
+	}
+	t := &CommandTransport{
+		cmd:         cmd,
+		logger:      log.Default(),
+		termTimeout: 5 * time.Second,
+		killTimeout: 5 * time.Second,
+		stderrDone:  make(chan struct{}),
+		exited:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	// Use plain pipes rather than cmd.StdoutPipe and friends: Wait closes
+	// those, which would race with a reader still draining the output.
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		closeAll(stdinR, stdinW)
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		closeAll(stdinR, stdinW, stdoutR, stdoutW)
+		return nil, err
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = stdinR, stdoutW, stderrW
+	if err := cmd.Start(); err != nil {
+		closeAll(stdinR, stdinW, stdoutR, stdoutW, stderrR, stderrW)
+		return nil, err
+	}
+	// The child holds its own copies of these ends.
+	closeAll(stdinR, stdoutW, stderrW)
+	t.stdin = stdinW
+	t.stream = NewStreamTransport(stdoutR, stdinW)
+
+	go t.forwardStderr(stderrR)
+	go func() {
+		t.waitErr = cmd.Wait()
+		close(t.exited)
+	}()
+	return t, nil
+}
+
+// forwardStderr copies the subprocess's stderr to the logger line by line.
+// Lines longer than the reader's buffer are logged in pieces.
+func (t *CommandTransport) forwardStderr(r *os.File) {
+	defer close(t.stderrDone)
+	defer r.Close()
+	reader := bufio.NewReaderSize(r, 64<<10)
+	for {
+		line, _, err := reader.ReadLine()
+		if err != nil {
+			break
+		}
+		if t.logger != nil {
+			t.logger.Printf("[%s] %s", t.cmd.Path, line)
+		}
+	}
+	// Keep the pipe drained so that the subprocess never blocks on it or
+	// dies writing to it.
+	io.Copy(io.Discard, r)
+}
+
+// ReadMessage reads a JSON-RPC message from the subprocess's stdout. It
+// returns io.EOF once the subprocess has exited or the transport is closed.
+func (t *CommandTransport) ReadMessage() (json.RawMessage, error) {
+	return t.stream.ReadMessage()
+}
+
+// WriteMessage writes a JSON-RPC message to the subprocess's stdin.
+func (t *CommandTransport) WriteMessage(message json.RawMessage) error {
+	return t.stream.WriteMessage(message)
+}
+
+// Close closes the subprocess's stdin and waits for it to exit, sending
+// SIGTERM and then SIGKILL if it does not exit within the close timeouts.
+// It returns the error reported by exec.Cmd.Wait, an *exec.ExitError if the
+// subprocess exited with a non-zero status or was killed by a signal.
+func (t *CommandTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.stdin.Close()
+		if !t.waitExit(t.termTimeout) {
+			if err := t.cmd.Process.Signal(syscall.SIGTERM); err != nil || !t.waitExit(t.killTimeout) {
+				t.cmd.Process.Kill()
+				<-t.exited
+			}
+		}
+		// Give the stderr forwarder a moment to drain; a grandchild holding
+		// the pipe open must not block Close.
+		select {
+		case <-t.stderrDone:
+		case <-time.After(time.Second):
+		}
+		t.stream.Close()
+		t.closeErr = t.waitErr
+	})
+	return t.closeErr
+}
+
+// ProcessState returns the state of the exited subprocess, or nil while it is
+// still running.
+func (t *CommandTransport) ProcessState() *os.ProcessState {
+	select {
+	case <-t.exited:
+		return t.cmd.ProcessState
+	default:
+		return nil
+	}
+}
+
+// waitExit waits up to d for the subprocess to exit and reports whether it did.
+func (t *CommandTransport) waitExit(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.exited:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func closeAll(files ...*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
@@ -0,0 +1,211 @@
+package transports
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionThreshold is a reasonable size, in bytes, below which
+// messages are not worth compressing.
+const DefaultCompressionThreshold = 1024
+
+// Compressor implements a content coding, such as gzip. Compressors are
+// shared by all transports; see RegisterCompressor.
+type Compressor interface {
+	// Name returns the name of the coding as used in the Accept-Encoding and
+	// Content-Encoding headers, e.g. "gzip" or "zstd".
+	Name() string
+	NewWriter(w io.Writer) CompressWriter
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// CompressWriter compresses the data written to it. Flush writes out the
+// data written so far, so that event streams are not held back.
+type CompressWriter interface {
+	io.WriteCloser
+	Flush() error
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = []Compressor{gzipCompressor{}}
+)
+
+// RegisterCompressor makes a content coding available to all transports,
+// replacing a compressor of the same name. Only gzip is built in; other
+// codings such as zstd can be registered by wrapping a third-party package.
+// Codings are preferred in the order they were registered.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	for i, existing := range compressors {
+		if existing.Name() == c.Name() {
+			compressors[i] = c
+			return
+		}
+	}
+	compressors = append(compressors, c)
+}
+
+// Compressors returns the names of the registered codings in order of
+// preference.
+func Compressors() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	names := make([]string, len(compressors))
+	for i, c := range compressors {
+		names[i] = c.Name()
+	}
+	return names
+}
+
+// lookupCompressor returns the compressor registered under name.
+func lookupCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	for _, c := range compressors {
+		if strings.EqualFold(c.Name(), name) {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// negotiateCompressor returns the first registered coding listed in an
+// Accept-Encoding header, or nil if there is none.
+func negotiateCompressor(acceptEncoding string) Compressor {
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		if _, q, ok := strings.Cut(params, "q="); ok {
+			if v, err := strconv.ParseFloat(strings.TrimSpace(q), 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		if c, ok := lookupCompressor(strings.TrimSpace(name)); ok {
+			return c
+		}
+	}
+	return nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (gzipCompressor) NewWriter(w io.Writer) CompressWriter { return gzip.NewWriter(w) }
+
+func (gzipCompressor) NewReader(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+
+// WithCompression makes the HTTP handlers compress responses for clients
+// accepting a registered coding. Event streams are compressed as a whole;
+// JSON responses only from threshold bytes on. Compressed request bodies are
+// accepted either way.
+func WithCompression(threshold int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.compress = true
+		c.compressThreshold = threshold
+	}
+}
+
+// negotiate decodes a compressed request body and, if compression is
+// enabled, wraps w to compress the response. It reports false after
+// rejecting the request. The returned function must be called once the
+// response is complete.
+func (c handlerConfig) negotiate(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), bool) {
+	if c.compress {
+		w.Header().Set("Accept-Encoding", strings.Join(Compressors(), ", "))
+	}
+	if coding := r.Header.Get("Content-Encoding"); coding != "" && coding != "identity" {
+		compressor, ok := lookupCompressor(coding)
+		if !ok {
+			w.Header().Set("Accept-Encoding", strings.Join(Compressors(), ", "))
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return w, nil, false
+		}
+		body, err := compressor.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "bad request body: "+err.Error(), http.StatusBadRequest)
+			return w, nil, false
+		}
+		r.Body = body
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+	}
+	if !c.compress {
+		return w, func() {}, true
+	}
+	compressor := negotiateCompressor(r.Header.Get("Accept-Encoding"))
+	if compressor == nil {
+		return w, func() {}, true
+	}
+	cw := &compressResponseWriter{ResponseWriter: w, compressor: compressor, threshold: c.compressThreshold}
+	return cw, cw.close, true
+}
+
+// compressResponseWriter compresses a successful response if it is an event
+// stream or its first write reaches the threshold.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	compressor  Compressor
+	threshold   int
+	w           CompressWriter
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK && strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+		w.start()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		if len(p) >= w.threshold && w.Header().Get("Content-Encoding") == "" {
+			w.start()
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.w != nil {
+		return w.w.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush writes out the compressed data and flushes the response.
+func (w *compressResponseWriter) Flush() {
+	if w.w != nil {
+		w.w.Flush()
+	}
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *compressResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressResponseWriter) start() {
+	if w.w != nil {
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Encoding", w.compressor.Name())
+	h.Add("Vary", "Accept-Encoding")
+	h.Del("Content-Length")
+	w.w = w.compressor.NewWriter(w.ResponseWriter)
+}
+
+func (w *compressResponseWriter) close() {
+	if w.w != nil {
+		w.w.Close()
+	}
+}
@@ -0,0 +1,114 @@
+package transports
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// maxDecompressedSize limits the size of a decompressed message, so that a
+// small message cannot expand without bounds.
+const maxDecompressedSize = 64 << 20
+
+// CompressedTransport wraps a Transport to compress large messages once
+// both sides agreed on a coding, typically during initialize. A compressed
+// message is sent as a JSON object holding the coding and the compressed
+// message in base64, so it can pass through any transport.
+type CompressedTransport struct {
+	Transport
+	threshold  int
+	mu         sync.Mutex
+	compressor Compressor
+}
+
+// compressedMessage is the envelope of a compressed message. The field
+// order makes every envelope start with `{"compressed":`.
+type compressedMessage struct {
+	Compressed string `json:"compressed"`
+	Data       []byte `json:"data"`
+}
+
+var compressedPrefix = []byte(`{"compressed":`)
+
+// ErrMalformedMessage is returned by ReadMessage, possibly wrapped, for a
+// compressed message that could not be decoded. The message is skipped and
+// the transport stays usable.
+var ErrMalformedMessage = errors.New("transports: malformed compressed message")
+
+// NewCompressedTransport wraps t. Messages are written uncompressed until
+// SetEncoding is called; from then on, messages of at least threshold bytes
+// are compressed. Compressed messages are read at any time.
+func NewCompressedTransport(t Transport, threshold int) *CompressedTransport {
+	return &CompressedTransport{Transport: t, threshold: threshold}
+}
+
+// SetEncoding sets the coding of the messages written, which must be
+// registered. An empty name turns compression off.
+func (t *CompressedTransport) SetEncoding(name string) error {
+	var compressor Compressor
+	if name != "" {
+		var ok bool
+		if compressor, ok = lookupCompressor(name); !ok {
+			return fmt.Errorf("transports: unknown coding %q", name)
+		}
+	}
+	t.mu.Lock()
+	t.compressor = compressor
+	t.mu.Unlock()
+	return nil
+}
+
+// ReadMessage reads the next message, decompressing it if needed.
+func (t *CompressedTransport) ReadMessage() (json.RawMessage, error) {
+	msg, err := t.Transport.ReadMessage()
+	if err != nil || !bytes.HasPrefix(msg, compressedPrefix) {
+		return msg, err
+	}
+	var env compressedMessage
+	if err := json.Unmarshal(msg, &env); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	compressor, ok := lookupCompressor(env.Compressed)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown coding %q", ErrMalformedMessage, env.Compressed)
+	}
+	r, err := compressor.NewReader(bytes.NewReader(env.Data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, ErrMessageTooLarge
+	}
+	return json.RawMessage(data), nil
+}
+
+// WriteMessage writes a message, compressing it if it is large enough.
+func (t *CompressedTransport) WriteMessage(message json.RawMessage) error {
+	t.mu.Lock()
+	compressor := t.compressor
+	t.mu.Unlock()
+	if compressor == nil || len(message) < t.threshold {
+		return t.Transport.WriteMessage(message)
+	}
+	var buf bytes.Buffer
+	w := compressor.NewWriter(&buf)
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	env, err := json.Marshal(compressedMessage{Compressed: compressor.Name(), Data: buf.Bytes()})
+	if err != nil {
+		return err
+	}
+	return t.Transport.WriteMessage(env)
+}
@@ -0,0 +1,124 @@
+package transports
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// eventSession is the part of a session shared by the SSE and Streamable
+// HTTP handlers: the messages POSTed by the client, and the log of messages
+// sent to it over an event stream.
+type eventSession struct {
+	id       string
+	incoming chan json.RawMessage
+	log      *eventLog
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func newEventSession(historySize int) *eventSession {
+	return &eventSession{
+		id:       newSessionID(),
+		incoming: make(chan json.RawMessage),
+		log:      newEventLog(historySize),
+		closed:   make(chan struct{}),
+	}
+}
+
+// sessionID returns the session's ID.
+func (s *eventSession) sessionID() string {
+	return s.id
+}
+
+// ReadMessage returns the next message POSTed by the client.
+func (s *eventSession) ReadMessage() (json.RawMessage, error) {
+	select {
+	case msg := <-s.incoming:
+		return msg, nil
+	case <-s.closed:
+		return nil, io.EOF
+	}
+}
+
+// Close ends the session.
+func (s *eventSession) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// stream writes events, then those logged after them, as "message" events
+// until the client goes away or the session ends. cursor is the ID of the
+// event preceding the first of events, and eventID formats the ID sent with
+// each event.
+func (s *eventSession) stream(w http.ResponseWriter, r *http.Request, events []loggedEvent, cursor int64, eventID func(int64) string, heartbeat <-chan time.Time) {
+	flusher := w.(http.Flusher)
+	for {
+		for _, ev := range events {
+			if err := writeSSEEvent(w, eventID(ev.id), "message", ev.msg); err != nil {
+				return
+			}
+			cursor = ev.id
+			s.log.delivered(cursor)
+		}
+		flusher.Flush()
+		select {
+		case <-s.log.notify:
+		case <-heartbeat:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+		// Undelivered events are never evicted, so this cannot fail.
+		events, _ = s.log.after(cursor)
+	}
+}
+
+// sessionTable holds a handler's live sessions by ID.
+type sessionTable[S interface {
+	sessionID() string
+	Close() error
+}] struct {
+	mu       sync.Mutex
+	sessions map[string]S
+}
+
+// add registers a session, unless max sessions are registered already. A
+// max of zero means no limit.
+func (t *sessionTable[S]) add(sess S, max int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if max > 0 && len(t.sessions) >= max {
+		return false
+	}
+	if t.sessions == nil {
+		t.sessions = make(map[string]S)
+	}
+	t.sessions[sess.sessionID()] = sess
+	return true
+}
+
+// get returns the session with the given ID.
+func (t *sessionTable[S]) get(id string) (S, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sess, ok := t.sessions[id]
+	return sess, ok
+}
+
+// end removes a session and closes its transport.
+func (t *sessionTable[S]) end(sess S) {
+	t.mu.Lock()
+	delete(t.sessions, sess.sessionID())
+	t.mu.Unlock()
+	sess.Close()
+}
@@ -0,0 +1,242 @@
+package transports
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TokenSource supplies the bearer tokens sent in the Authorization header.
+type TokenSource interface {
+	// Token returns the token to use. After the server rejected a request
+	// with 401 Unauthorized, Token is called with refresh set so that the
+	// source can replace a cached token, and the request is retried once.
+	Token(ctx context.Context, refresh bool) (string, error)
+}
+
+// TokenSourceFunc adapts a function to the TokenSource interface.
+type TokenSourceFunc func(ctx context.Context, refresh bool) (string, error)
+
+// Token implements TokenSource.
+func (f TokenSourceFunc) Token(ctx context.Context, refresh bool) (string, error) {
+	return f(ctx, refresh)
+}
+
+// httpClient sends the requests of an HTTP-based transport, adding the
+// configured headers and credentials.
+type httpClient struct {
+	client     *http.Client
+	header     http.Header
+	headerFunc func(ctx context.Context) (http.Header, error)
+	tokens     TokenSource
+	compress   bool
+	threshold  int
+	// maxSize limits the messages read from responses.
+	maxSize int
+	// accepted holds the codings the server accepts for request bodies, as
+	// announced in its responses' Accept-Encoding header.
+	accepted *acceptedEncodings
+}
+
+type acceptedEncodings struct {
+	mu     sync.Mutex
+	header string
+}
+
+// HTTPOption configures the HTTP requests of an SSETransport or a
+// StreamableHTTPTransport. It is both an SSEOption and a StreamableOption.
+type HTTPOption func(*httpClient)
+
+var (
+	_ SSEOption        = HTTPOption(nil)
+	_ StreamableOption = HTTPOption(nil)
+)
+
+func (o HTTPOption) applySSE(t *SSETransport) { o(&t.http) }
+
+func (o HTTPOption) applyStreamable(t *StreamableHTTPTransport) { o(&t.http) }
+
+// WithHTTPClient sets the client used for all requests, e.g. one configured
+// with custom CAs, client certificates or a proxy. The client should not
+// have a Timeout, as it would cut off the long-lived event stream.
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(c *httpClient) {
+		c.client = client
+	}
+}
+
+// WithHeader adds a header sent with every request.
+func WithHeader(key, value string) HTTPOption {
+	return func(c *httpClient) {
+		c.header.Add(key, value)
+	}
+}
+
+// WithHeaderFunc sets a function called before every request for headers
+// to add to it, e.g. a request ID. An error aborts the request.
+func WithHeaderFunc(f func(ctx context.Context) (http.Header, error)) HTTPOption {
+	return func(c *httpClient) {
+		c.headerFunc = f
+	}
+}
+
+// WithTokenSource sets the source of bearer tokens sent with every request.
+func WithTokenSource(tokens TokenSource) HTTPOption {
+	return func(c *httpClient) {
+		c.tokens = tokens
+	}
+}
+
+// WithRequestCompression makes the transport accept compressed responses in
+// every registered coding, and compress request bodies of at least threshold
+// bytes once the server announced a coding it accepts.
+func WithRequestCompression(threshold int) HTTPOption {
+	return func(c *httpClient) {
+		c.compress = true
+		c.threshold = threshold
+	}
+}
+
+// WithMaxEventSize limits the size of a message read from the server, in an
+// event or a JSON response. The default is DefaultMaxMessageSize. A larger
+// message is skipped, and ReadMessage returns ErrMessageTooLarge in its
+// place.
+func WithMaxEventSize(n int) HTTPOption {
+	return func(c *httpClient) {
+		if n > 0 {
+			c.maxSize = n
+		}
+	}
+}
+
+func newHTTPClient() httpClient {
+	return httpClient{client: &http.Client{}, header: make(http.Header), maxSize: DefaultMaxMessageSize, accepted: &acceptedEncodings{}}
+}
+
+// encode compresses a request body if it is large enough and the server
+// accepts a registered coding. It returns the body and its coding, if any.
+func (c *httpClient) encode(body []byte) ([]byte, string) {
+	if !c.compress || len(body) < c.threshold {
+		return body, ""
+	}
+	c.accepted.mu.Lock()
+	compressor := negotiateCompressor(c.accepted.header)
+	c.accepted.mu.Unlock()
+	if compressor == nil {
+		return body, ""
+	}
+	var buf bytes.Buffer
+	w := compressor.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return body, ""
+	}
+	if err := w.Close(); err != nil {
+		return body, ""
+	}
+	return buf.Bytes(), compressor.Name()
+}
+
+// decode records the codings the server accepts and decompresses the
+// response body.
+func (c *httpClient) decode(resp *http.Response) error {
+	if accepted := resp.Header.Get("Accept-Encoding"); accepted != "" {
+		c.accepted.mu.Lock()
+		c.accepted.header = accepted
+		c.accepted.mu.Unlock()
+	}
+	coding := resp.Header.Get("Content-Encoding")
+	if coding == "" || coding == "identity" {
+		return nil
+	}
+	compressor, ok := lookupCompressor(coding)
+	if !ok {
+		return nil
+	}
+	body, err := compressor.NewReader(resp.Body)
+	if err != nil {
+		return err
+	}
+	resp.Body = readCloser{body, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// readCloser reads from a decompressing reader and closes the underlying
+// body too.
+type readCloser struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (r readCloser) Close() error {
+	r.ReadCloser.Close()
+	return r.body.Close()
+}
+
+// do sends req with the configured headers. If the server answers 401 and a
+// token source is set, the token is refreshed and the request sent again.
+func (c *httpClient) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.roundTrip(req)
+	if err != nil || !c.compress {
+		return resp, err
+	}
+	if err := c.decode(resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *httpClient) roundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.send(req.Clone(req.Context()), false)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || c.tokens == nil {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The body was consumed and can't be sent again.
+		return resp, nil
+	}
+	resp.Body.Close()
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(retry, true)
+}
+
+// send adds the headers to req and sends it.
+func (c *httpClient) send(req *http.Request, refresh bool) (*http.Response, error) {
+	ctx := req.Context()
+	for key, values := range c.header {
+		req.Header[key] = append(req.Header[key], values...)
+	}
+	if c.headerFunc != nil {
+		header, err := c.headerFunc(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			for _, value := range values {
+				req.Header.Add(key, value)
+			}
+		}
+	}
+	if c.compress && req.Header.Get("Accept-Encoding") == "" {
+		req.Header.Set("Accept-Encoding", strings.Join(Compressors(), ", "))
+	}
+	if c.tokens != nil {
+		token, err := c.tokens.Token(ctx, refresh)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return c.client.Do(req)
+}
@@ -0,0 +1,292 @@
+package transports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Listener accepts connections on a Unix socket or TCP port and serves each
+// as a separate session of a Server. Messages are framed like a
+// StreamTransport.
+type Listener struct {
+	ln     net.Listener
+	config listenConfig
+	mu     sync.Mutex
+	conns  map[*StreamTransport]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// ListenOption configures a Listener.
+type ListenOption func(*listenConfig)
+
+type listenConfig struct {
+	mode        os.FileMode
+	uid, gid    int
+	streamOpts  []StreamOption
+	removeStale bool
+}
+
+// WithSocketMode sets the permissions of the Unix socket file, e.g. 0600 to
+// only admit the owner. By default the process umask applies. Clients can
+// only connect once the permissions are in place.
+func WithSocketMode(mode os.FileMode) ListenOption {
+	return func(c *listenConfig) {
+		c.mode = mode
+	}
+}
+
+// WithSocketOwner sets the owner and group of the Unix socket file. A value
+// of -1 leaves the owner or group unchanged.
+func WithSocketOwner(uid, gid int) ListenOption {
+	return func(c *listenConfig) {
+		c.uid, c.gid = uid, gid
+	}
+}
+
+// WithStaleSocketRemoval makes Listen remove a socket file left behind by a
+// process that exited without closing its listener. A socket with a live
+// listener is never removed.
+func WithStaleSocketRemoval() ListenOption {
+	return func(c *listenConfig) {
+		c.removeStale = true
+	}
+}
+
+// WithConnOptions sets the options of the stream transport serving each
+// connection.
+func WithConnOptions(opts ...StreamOption) ListenOption {
+	return func(c *listenConfig) {
+		c.streamOpts = opts
+	}
+}
+
+// Listen listens on a Unix socket ("unix") or a TCP address ("tcp", "tcp4",
+// "tcp6"). Call Serve to serve the connections.
+func Listen(network, addr string, opts ...ListenOption) (*Listener, error) {
+	config := listenConfig{uid: -1, gid: -1}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	switch network {
+	case "unix":
+	case "tcp", "tcp4", "tcp6":
+		if config.mode != 0 || config.uid != -1 || config.gid != -1 {
+			return nil, errors.New("transports: socket permissions only apply to unix sockets")
+		}
+	default:
+		return nil, fmt.Errorf("transports: unsupported network %q", network)
+	}
+	var (
+		ln  net.Listener
+		err error
+	)
+	if network == "unix" && (config.mode != 0 || config.uid != -1 || config.gid != -1) {
+		ln, err = listenPrivate(addr, config)
+	} else {
+		ln, err = net.Listen(network, addr)
+		if err != nil && network == "unix" && config.removeStale && errors.Is(err, syscall.EADDRINUSE) && staleSocket(addr) {
+			os.Remove(addr)
+			ln, err = net.Listen(network, addr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{ln: ln, config: config, conns: make(map[*StreamTransport]struct{})}, nil
+}
+
+// listenPrivate listens on a Unix socket that only appears at path once its
+// permissions are set: the socket is created in a directory only the
+// process can access and then linked into place. Unlike a rename, linking
+// fails if path exists, so a live listener's socket is never replaced.
+func listenPrivate(path string, config listenConfig) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".mcp-socket-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, "socket")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	ln.SetUnlinkOnClose(false)
+	if err := setSocketPermissions(tmp, config); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	err = os.Link(tmp, path)
+	if errors.Is(err, fs.ErrExist) && config.removeStale && staleSocket(path) {
+		os.Remove(path)
+		err = os.Link(tmp, path)
+	}
+	if err != nil {
+		ln.Close()
+		if errors.Is(err, fs.ErrExist) {
+			err = syscall.EADDRINUSE
+		}
+		return nil, &net.OpError{Op: "listen", Net: "unix", Addr: &net.UnixAddr{Name: path, Net: "unix"}, Err: err}
+	}
+	return linkedListener{Listener: ln, path: path}, nil
+}
+
+// linkedListener is a Unix socket listener reachable at path. Like the
+// listeners of the net package, it removes the socket file when closed.
+type linkedListener struct {
+	net.Listener
+	path string
+}
+
+func (l linkedListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l linkedListener) Close() error {
+	err := l.Listener.Close()
+	os.Remove(l.path)
+	return err
+}
+
+// staleSocket reports whether nothing is listening on the socket at path.
+func staleSocket(path string) bool {
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return false
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// setSocketPermissions applies the configured mode and owner to the socket
+// file.
+func setSocketPermissions(path string, config listenConfig) error {
+	if config.mode != 0 {
+		if err := os.Chmod(path, config.mode); err != nil {
+			return err
+		}
+	}
+	if config.uid != -1 || config.gid != -1 {
+		return os.Chown(path, config.uid, config.gid)
+	}
+	return nil
+}
+
+// Addr returns the address the listener accepts connections on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// Serve accepts connections and serves each as a new session of server,
+// until the listener is closed. It returns nil after Close. Accept errors
+// that may pass, like running out of file descriptors, are retried after a
+// delay.
+func (l *Listener) Serve(server Server) error {
+	var delay time.Duration
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			closed := l.closed
+			l.mu.Unlock()
+			if closed {
+				return nil
+			}
+			if temporaryAcceptError(err) {
+				// Like net/http, back off while e.g. out of file
+				// descriptors rather than give up on the listener.
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("transports: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		t := newConnTransport(conn, l.config.streamOpts...)
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			t.Close()
+			return nil
+		}
+		l.conns[t] = struct{}{}
+		l.wg.Add(1)
+		l.mu.Unlock()
+		go func() {
+			defer l.wg.Done()
+			server.Serve(t)
+			t.Close()
+			l.mu.Lock()
+			delete(l.conns, t)
+			l.mu.Unlock()
+		}()
+	}
+}
+
+// temporaryAcceptError reports whether Accept may succeed when retried.
+func temporaryAcceptError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their sessions to end. A Unix socket file is removed.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	err := l.ln.Close()
+	for t := range l.conns {
+		t.Close()
+	}
+	l.mu.Unlock()
+	l.wg.Wait()
+	return err
+}
+
+// Dial connects to a Listener on a Unix socket or TCP address.
+func Dial(ctx context.Context, network, addr string, opts ...StreamOption) (*StreamTransport, error) {
+	switch network {
+	case "unix", "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("transports: unsupported network %q", network)
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newConnTransport(conn, opts...), nil
+}
+
+// newConnTransport returns a stream transport over conn. The connection is
+// only passed as the writer to be closed, so that Close closes it once.
+func newConnTransport(conn net.Conn, opts ...StreamOption) *StreamTransport {
+	return NewStreamTransport(struct{ io.Reader }{conn}, conn, opts...)
+}
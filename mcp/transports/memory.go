@@ -0,0 +1,94 @@
+package transports
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// InMemoryTransport is one end of a pair of connected transports created by
+// NewInMemoryPair. Messages are passed as values, without any framing.
+type InMemoryTransport struct {
+	in      chan delivery
+	out     chan delivery
+	latency time.Duration
+	closed  chan struct{}
+	once    *sync.Once
+}
+
+type delivery struct {
+	msg json.RawMessage
+	at  time.Time
+}
+
+// InMemoryOption configures a pair of in-memory transports.
+type InMemoryOption func(*InMemoryTransport)
+
+// WithLatency delays the delivery of every message by d, e.g. to exercise
+// timeouts in tests. Messages are still delivered in order.
+func WithLatency(d time.Duration) InMemoryOption {
+	return func(t *InMemoryTransport) {
+		t.latency = d
+	}
+}
+
+// NewInMemoryPair returns two connected transports: messages written to one
+// are read from the other. Closing either end closes both; reads then return
+// io.EOF once the messages already sent have been read.
+func NewInMemoryPair(opts ...InMemoryOption) (*InMemoryTransport, *InMemoryTransport) {
+	ab := make(chan delivery, 64)
+	ba := make(chan delivery, 64)
+	closed := make(chan struct{})
+	once := &sync.Once{}
+	a := &InMemoryTransport{in: ba, out: ab, closed: closed, once: once}
+	b := &InMemoryTransport{in: ab, out: ba, closed: closed, once: once}
+	for _, opt := range opts {
+		opt(a)
+		opt(b)
+	}
+	return a, b
+}
+
+// ReadMessage reads the next message written to the other end.
+func (t *InMemoryTransport) ReadMessage() (json.RawMessage, error) {
+	var d delivery
+	select {
+	case d = <-t.in:
+	default:
+		select {
+		case d = <-t.in:
+		case <-t.closed:
+			return nil, io.EOF
+		}
+	}
+	time.Sleep(time.Until(d.at))
+	return d.msg, nil
+}
+
+// WriteMessage sends a copy of message to the other end.
+func (t *InMemoryTransport) WriteMessage(message json.RawMessage) error {
+	d := delivery{
+		msg: append(json.RawMessage(nil), message...),
+		at:  time.Now().Add(t.latency),
+	}
+	select {
+	case <-t.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	select {
+	case t.out <- d:
+		return nil
+	case <-t.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+// Close closes both ends of the pair.
+func (t *InMemoryTransport) Close() error {
+	t.once.Do(func() {
+		close(t.closed)
+	})
+	return nil
+}
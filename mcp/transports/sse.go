@@ -1,94 +1,441 @@
 package transports
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"sync"
+	"time"
 )
 
+// ConnectionState is the state of an SSETransport's event stream.
+type ConnectionState int
+
+const (
+	// StateConnecting means the first connection attempt is in progress.
+	StateConnecting ConnectionState = iota
+	// StateConnected means the event stream is open.
+	StateConnected
+	// StateReconnecting means the event stream was lost and the transport is
+	// waiting to reconnect.
+	StateReconnecting
+	// StateFailed means the transport gave up reconnecting.
+	StateFailed
+	// StateClosed means the transport was closed.
+	StateClosed
+)
+
+// String returns the name of the state.
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateFailed:
+		return "failed"
+	case StateClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("ConnectionState(%d)", int(s))
+}
+
+// ReconnectPolicy controls how an SSETransport reconnects its event stream.
+// The delay before each attempt grows from InitialDelay by Multiplier up to
+// MaxDelay, with random jitter. A retry interval sent by the server replaces
+// InitialDelay.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Multiplier   float64
+	// MaxAttempts is the number of consecutive failed attempts after which
+	// the transport fails. Zero means no limit.
+	MaxAttempts int
+}
+
+// DefaultReconnectPolicy is the reconnect policy used unless one is set with
+// WithReconnectPolicy.
+var DefaultReconnectPolicy = ReconnectPolicy{
+	InitialDelay: time.Second,
+	MaxDelay:     30 * time.Second,
+	Multiplier:   2,
+	MaxAttempts:  10,
+}
+
+// SSEOption configures an SSETransport. The HTTPOptions apply as well.
+type SSEOption interface {
+	applySSE(t *SSETransport)
+}
+
+// sseOption is an SSEOption applying only to SSETransport.
+type sseOption func(*SSETransport)
+
+func (o sseOption) applySSE(t *SSETransport) { o(t) }
+
+// WithReconnectPolicy sets how the transport reconnects a lost event stream.
+func WithReconnectPolicy(policy ReconnectPolicy) SSEOption {
+	return sseOption(func(t *SSETransport) {
+		t.policy = policy
+	})
+}
+
+// WithConnectionStateHandler sets a function called whenever the state of
+// the event stream changes. err is the reason for StateReconnecting and
+// StateFailed.
+func WithConnectionStateHandler(handler func(state ConnectionState, err error)) SSEOption {
+	return sseOption(func(t *SSETransport) {
+		t.onState = handler
+	})
+}
+
+// WithUnknownEventHandler sets a function called for events other than
+// "message" and "endpoint", which the transport otherwise ignores.
+func WithUnknownEventHandler(handler func(event, data string)) SSEOption {
+	return sseOption(func(t *SSETransport) {
+		t.onUnknownEvent = handler
+	})
+}
+
 // SSETransport implements the Transport interface using Server-Sent Events.
+// The event stream is parsed following the WHATWG rules. The server's
+// "endpoint" event announces the URL messages are POSTed to, and "message"
+// events carry the server's messages. A server announcing no endpoint is
+// sent messages at url+"/request". A lost event stream is reconnected
+// automatically, sending the ID of the last event received so that the
+// server can replay what was missed.
 type SSETransport struct {
-	url       string
-	client    *http.Client
-	eventChan chan json.RawMessage
-	stop      chan struct{}
-	wg        sync.WaitGroup
+	url            string
+	http           httpClient
+	policy         ReconnectPolicy
+	onState        func(ConnectionState, error)
+	onUnknownEvent func(event, data string)
+	endpointWait   time.Duration
+	eventChan      chan readResult
+	mu             sync.Mutex
+	endpoint       string
+	lastEventID    string
+	retry          time.Duration
+	err            error
+	ready          chan struct{}
+	readyOnce      sync.Once
+	failed         chan struct{}
+	ctx            context.Context
+	cancel         context.CancelFunc
+	stop           chan struct{}
+	closeOnce      sync.Once
+	wg             sync.WaitGroup
 }
 
 // NewSSETransport creates a new SSE transport instance.
-func NewSSETransport(url string) *SSETransport {
+func NewSSETransport(url string, opts ...SSEOption) *SSETransport {
 	t := &SSETransport{
-		url:       url,
-		client:    &http.Client{},
-		eventChan: make(chan json.RawMessage),
-		stop:      make(chan struct{}),
+		url:          url,
+		http:         newHTTPClient(),
+		policy:       DefaultReconnectPolicy,
+		endpointWait: time.Second,
+		eventChan:    make(chan readResult),
+		ready:        make(chan struct{}),
+		failed:       make(chan struct{}),
+		stop:         make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt.applySSE(t)
 	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
 	t.wg.Add(1)
 	go t.readLoop()
 	return t
 }
 
-// readLoop reads SSE events from the server.
+// WithEndpointTimeout sets how long after connecting the transport waits for
+// the server's "endpoint" event before falling back to url+"/request". The
+// default is one second; zero waits for the event or the first message.
+func WithEndpointTimeout(d time.Duration) SSEOption {
+	return sseOption(func(t *SSETransport) {
+		t.endpointWait = d
+	})
+}
+
+// permanentError wraps errors that must not be retried.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// readLoop keeps the event stream connected until the transport is closed or
+// reconnecting fails.
 func (t *SSETransport) readLoop() {
 	defer t.wg.Done()
-	req, _ := http.NewRequest("GET", t.url+"/events", nil)
-	resp, err := t.client.Do(req)
-	if err != nil {
-		return
-	}
-	defer resp.Body.Close()
-	reader := bufio.NewReader(resp.Body)
+	t.setState(StateConnecting, nil)
+	attempts := 0
 	for {
+		connected, err := t.connect()
 		select {
 		case <-t.stop:
 			return
 		default:
-			line, err := reader.ReadString('\n')
-			if err != nil {
-				return
+		}
+		if connected {
+			attempts = 0
+		}
+		attempts++
+		var permanent permanentError
+		if errors.As(err, &permanent) || (t.policy.MaxAttempts > 0 && attempts > t.policy.MaxAttempts) {
+			t.fail(err)
+			return
+		}
+		t.setState(StateReconnecting, err)
+		timer := time.NewTimer(t.backoff(attempts))
+		select {
+		case <-timer.C:
+		case <-t.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// connect opens the event stream and reads it until it ends. It reports
+// whether the stream was opened, and why it ended.
+func (t *SSETransport) connect() (bool, error) {
+	req, err := http.NewRequestWithContext(t.ctx, "GET", t.url+"/events", nil)
+	if err != nil {
+		return false, permanentError{err}
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	t.mu.Lock()
+	lastEventID := t.lastEventID
+	t.mu.Unlock()
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := t.http.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		// The server asks the client to stop reconnecting.
+		return false, permanentError{errors.New("server closed the event stream")}
+	case resp.StatusCode == http.StatusNotFound && lastEventID != "":
+		// The session to resume is gone; a new one would not be initialized.
+		return false, permanentError{ErrSessionNotFound}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+		return false, fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return false, permanentError{fmt.Errorf("unexpected status: %d", resp.StatusCode)}
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		return false, permanentError{fmt.Errorf("unexpected content type: %q", resp.Header.Get("Content-Type"))}
+	}
+	t.setState(StateConnected, nil)
+	if t.endpointWait > 0 {
+		fallback := time.AfterFunc(t.endpointWait, func() {
+			t.setEndpoint(t.url + "/request")
+		})
+		defer fallback.Stop()
+	}
+
+	events := newSSEReader(resp.Body, lastEventID, t.http.maxSize)
+	for {
+		ev, err := events.next()
+		t.mu.Lock()
+		t.lastEventID = events.lastID
+		if events.retry > 0 {
+			t.retry = events.retry
+		}
+		t.mu.Unlock()
+		if err == ErrMessageTooLarge {
+			// The event was skipped; the stream stays usable.
+			select {
+			case t.eventChan <- readResult{err: err}:
+				continue
+			case <-t.stop:
+				return true, nil
 			}
-			if bytes.HasPrefix([]byte(line), []byte("data: ")) {
-				data := bytes.TrimPrefix([]byte(line), []byte("data: "))
-				data = bytes.TrimSpace(data)
-				var msg json.RawMessage
-				if json.Unmarshal(data, &msg) == nil {
-					t.eventChan <- msg
-				}
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
 			}
+			return true, err
 		}
+		switch ev.event {
+		case "endpoint":
+			t.resolveEndpoint(ev.data)
+		case "message":
+			// Without an endpoint event, fall back to the conventional POST URL.
+			t.setEndpoint(t.url + "/request")
+			if ev.data == "" {
+				continue
+			}
+			// The message is not validated here; the client reports
+			// malformed messages.
+			select {
+			case t.eventChan <- readResult{msg: json.RawMessage(ev.data)}:
+			case <-t.stop:
+				return true, nil
+			}
+		default:
+			if t.onUnknownEvent != nil {
+				t.onUnknownEvent(ev.event, ev.data)
+			}
+		}
+	}
+}
+
+// backoff returns the delay before the given reconnection attempt.
+func (t *SSETransport) backoff(attempt int) time.Duration {
+	t.mu.Lock()
+	d := t.retry
+	t.mu.Unlock()
+	if d <= 0 {
+		d = t.policy.InitialDelay
+	}
+	for i := 1; i < attempt && (t.policy.MaxDelay <= 0 || d < t.policy.MaxDelay); i++ {
+		d = time.Duration(float64(d) * t.policy.Multiplier)
+	}
+	if t.policy.MaxDelay > 0 && d > t.policy.MaxDelay {
+		d = t.policy.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	// Jitter between half and the full delay.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// resolveEndpoint sets the POST URL announced by the server's endpoint
+// event, which may be relative to the URL of the event stream.
+func (t *SSETransport) resolveEndpoint(ref string) {
+	base, err := url.Parse(t.url + "/events")
+	if err != nil {
+		return
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.endpoint = u.String()
+	t.mu.Unlock()
+	t.readyOnce.Do(func() {
+		close(t.ready)
+	})
+}
+
+// setEndpoint sets the POST URL, unless it was already set.
+func (t *SSETransport) setEndpoint(endpoint string) {
+	t.readyOnce.Do(func() {
+		t.mu.Lock()
+		t.endpoint = endpoint
+		t.mu.Unlock()
+		close(t.ready)
+	})
+}
+
+// setState reports a state change to the connection state handler.
+func (t *SSETransport) setState(state ConnectionState, err error) {
+	if t.onState != nil {
+		t.onState(state, err)
 	}
 }
 
-// ReadMessage reads a message from the SSE event channel.
+// fail stops the transport after reconnecting failed.
+func (t *SSETransport) fail(err error) {
+	t.mu.Lock()
+	t.err = fmt.Errorf("transports: event stream failed: %w", err)
+	t.mu.Unlock()
+	close(t.failed)
+	t.setState(StateFailed, err)
+}
+
+// failure returns the error that made the transport fail.
+func (t *SSETransport) failure() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// ReadMessage reads a message from the SSE event channel. It returns an
+// error once reconnecting the event stream failed, and ErrMessageTooLarge
+// for a skipped message.
 func (t *SSETransport) ReadMessage() (json.RawMessage, error) {
 	select {
-	case msg := <-t.eventChan:
-		return msg, nil
+	case r := <-t.eventChan:
+		return r.msg, r.err
+	case <-t.failed:
+		return nil, t.failure()
 	case <-t.stop:
 		return nil, io.EOF
 	}
 }
 
-// WriteMessage sends a message to the server via HTTP POST.
+// WriteMessage sends a message to the server via HTTP POST. It waits for the
+// server to announce its endpoint first, or for the endpoint timeout to pass.
 func (t *SSETransport) WriteMessage(message json.RawMessage) error {
-	resp, err := t.client.Post(t.url+"/request", "application/json", bytes.NewReader(message))
+	select {
+	case <-t.ready:
+	case <-t.failed:
+		return t.failure()
+	case <-t.stop:
+		return io.ErrClosedPipe
+	}
+	t.mu.Lock()
+	endpoint := t.endpoint
+	t.mu.Unlock()
+	body, coding := t.http.encode(message)
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if coding != "" {
+		req.Header.Set("Content-Encoding", coding)
+	}
+	resp, err := t.http.do(req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
 	}
 	return nil
 }
 
-// Close shuts down the SSE transport.
+// Close ends the session with a DELETE request to the POST URL, if one was
+// announced, and shuts down the SSE transport.
 func (t *SSETransport) Close() error {
-	close(t.stop)
-	t.wg.Wait()
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		t.cancel()
+		t.wg.Wait()
+		t.mu.Lock()
+		endpoint := t.endpoint
+		t.mu.Unlock()
+		if endpoint != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+			if err == nil {
+				if resp, err := t.http.do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}
+		t.setState(StateClosed, nil)
+	})
 	return nil
 }
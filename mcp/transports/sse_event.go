@@ -0,0 +1,284 @@
+package transports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseEvent is an event read from an event stream.
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// sseReader parses an event stream following the WHATWG rules: lines end
+// with CRLF, LF or CR, multiple data fields are joined with newlines, the
+// last event ID persists across events, and comments are skipped.
+type sseReader struct {
+	r       *bufio.Reader
+	maxSize int
+	// lastID is the last event ID, committed at the end of each event even
+	// if it has no data; idBuffer holds the ID of the event being read.
+	lastID   string
+	idBuffer string
+	retry    time.Duration
+	started  bool
+}
+
+// newSSEReader returns a reader for an event stream resumed after the event
+// with the given ID, if any, skipping events with more than maxSize bytes of
+// data.
+func newSSEReader(r io.Reader, lastID string, maxSize int) *sseReader {
+	return &sseReader{r: bufio.NewReader(r), maxSize: maxSize, lastID: lastID, idBuffer: lastID}
+}
+
+// readLine reads a line without its terminator. A line longer than the
+// maximum size is consumed, and reported with ErrMessageTooLarge.
+func (p *sseReader) readLine() (string, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\n':
+		case '\r':
+			if next, err := p.r.Peek(1); err == nil && next[0] == '\n' {
+				p.r.ReadByte()
+			}
+		default:
+			// Leave room for the field name, so that data of the maximum
+			// size fits on a line.
+			if tooLarge = tooLarge || len(line) >= p.maxSize+len("data: "); !tooLarge {
+				line = append(line, b)
+			}
+			continue
+		}
+		if tooLarge {
+			return "", ErrMessageTooLarge
+		}
+		return string(line), nil
+	}
+}
+
+// next returns the next event. At the end of the stream it returns io.EOF,
+// discarding an incomplete event. An event with too much data is skipped,
+// and reported with ErrMessageTooLarge once it was read entirely.
+func (p *sseReader) next() (sseEvent, error) {
+	var (
+		event    string
+		data     strings.Builder
+		hasData  bool
+		tooLarge bool
+	)
+	for {
+		line, err := p.readLine()
+		if err == ErrMessageTooLarge {
+			tooLarge = true
+			continue
+		}
+		if err != nil {
+			return sseEvent{}, err
+		}
+		if !p.started {
+			p.started = true
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if line == "" {
+			p.lastID = p.idBuffer
+			if tooLarge {
+				return sseEvent{}, ErrMessageTooLarge
+			}
+			if !hasData {
+				event = ""
+				continue
+			}
+			if event == "" {
+				event = "message"
+			}
+			return sseEvent{id: p.lastID, event: event, data: strings.TrimSuffix(data.String(), "\n")}, nil
+		}
+		if line[0] == ':' {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			if tooLarge = tooLarge || data.Len()+len(value) > p.maxSize; tooLarge {
+				data.Reset()
+				continue
+			}
+			data.WriteString(value)
+			data.WriteByte('\n')
+			hasData = true
+		case "id":
+			if !strings.ContainsRune(value, 0) {
+				p.idBuffer = value
+			}
+		case "retry":
+			if ms, err := strconv.ParseUint(value, 10, 63); err == nil {
+				p.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// writeSSEEvent writes an event to an event stream. Empty id and event
+// fields are omitted.
+func writeSSEEvent(w io.Writer, id, event string, data []byte) error {
+	var buf bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&buf, "id: %s\n", id)
+	}
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// errEventsEvicted is returned when a stream resumes after an event that is
+// no longer kept, so the events following it cannot be replayed.
+var errEventsEvicted = errors.New("transports: missed events are no longer available")
+
+// eventLog queues the messages sent on an event stream and keeps the newest
+// ones written to a stream, so they can be replayed to a client resuming
+// with Last-Event-ID. While a stream is attached, writers block once size
+// messages are waiting for it, so none is dropped before it was written.
+// With no stream attached, the oldest events are given up instead, so that
+// writers never wait for a client that may not come back.
+type eventLog struct {
+	mu       sync.Mutex
+	lastID   int64
+	sent     int64
+	attached bool
+	// events holds the delivered events kept for replay, followed by the
+	// ones waiting for a stream. IDs are consecutive.
+	events []loggedEvent
+	size   int
+	notify chan struct{}
+	space  chan struct{}
+}
+
+type loggedEvent struct {
+	id  int64
+	msg json.RawMessage
+}
+
+func newEventLog(size int) *eventLog {
+	return &eventLog{size: size, notify: make(chan struct{}, 1), space: make(chan struct{})}
+}
+
+// append adds a message to the log and wakes up the stream writing it. While
+// a stream is attached, it waits while the log is full of undelivered
+// messages, and returns io.ErrClosedPipe if done is closed first.
+func (l *eventLog) append(msg json.RawMessage, done <-chan struct{}) error {
+	limit := int64(max(l.size, 1))
+	for {
+		l.mu.Lock()
+		for !l.attached && l.lastID-l.sent >= limit {
+			l.sent = max(l.sent, l.events[0].id)
+			l.events = l.events[1:]
+		}
+		if l.lastID-l.sent < limit {
+			l.lastID++
+			l.events = append(l.events, loggedEvent{id: l.lastID, msg: msg})
+			l.mu.Unlock()
+			select {
+			case l.notify <- struct{}{}:
+			default:
+			}
+			return nil
+		}
+		space := l.space
+		l.mu.Unlock()
+		select {
+		case <-space:
+		case <-done:
+			return io.ErrClosedPipe
+		}
+	}
+}
+
+// after returns the logged events after the given event ID. It returns
+// errEventsEvicted if events following id are no longer kept, or id is
+// unknown.
+func (l *eventLog) after(id int64) ([]loggedEvent, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	oldest := l.lastID - int64(len(l.events)) + 1
+	if id > l.lastID || id+1 < oldest {
+		return nil, errEventsEvicted
+	}
+	return append([]loggedEvent(nil), l.events[id+1-oldest:]...), nil
+}
+
+// delivered records that the events up to id were written to a stream. Of
+// those, only the newest size are kept.
+func (l *eventLog) delivered(id int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if id <= l.sent {
+		return
+	}
+	l.sent = id
+	for len(l.events) > 0 && l.events[0].id <= l.sent-int64(l.size) {
+		l.events = l.events[1:]
+	}
+	close(l.space)
+	l.space = make(chan struct{})
+}
+
+// attach marks a stream as reading the log. It reports false if one already
+// is.
+func (l *eventLog) attach() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.attached {
+		return false
+	}
+	l.attached = true
+	return true
+}
+
+// detach marks the stream as gone, releasing the writers waiting for it.
+func (l *eventLog) detach() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.attached = false
+	close(l.space)
+	l.space = make(chan struct{})
+}
+
+// isAttached reports whether a stream is reading the log.
+func (l *eventLog) isAttached() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.attached
+}
+
+// lastDelivered returns the ID of the last event written to a stream.
+func (l *eventLog) lastDelivered() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sent
+}
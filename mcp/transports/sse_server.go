@@ -0,0 +1,309 @@
+package transports
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server serves a session over a transport. *mcp.Server implements it.
+type Server interface {
+	Serve(transport Transport) error
+}
+
+// SSEHandler is an http.Handler serving a Server over the SSE transport. A
+// GET request to the events endpoint, conventionally ".../events", opens a
+// session and streams the server's messages as "message" events. The first
+// event, "endpoint", announces the URL the client POSTs its messages to,
+// which carries the session ID.
+//
+// A session outlives its event stream for the resume window: a client
+// reconnecting with the Last-Event-ID header gets the same session back, and
+// the messages it missed are replayed. A session that is gone is answered
+// with 404 Not Found rather than replaced, since the new session would not
+// be initialized.
+type SSEHandler struct {
+	server   Server
+	config   handlerConfig
+	sessions sessionTable[*sseSession]
+}
+
+// HandlerOption configures the HTTP handlers serving a Server.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	heartbeat     time.Duration
+	jsonResponses bool
+	historySize   int
+	resumeWindow  time.Duration
+	maxBodySize   int
+	maxSessions   int
+	idleTimeout   time.Duration
+	// compress enables compressed responses; see WithCompression.
+	compress          bool
+	compressThreshold int
+}
+
+func newHandlerConfig(opts []HandlerOption) handlerConfig {
+	c := handlerConfig{
+		heartbeat:    30 * time.Second,
+		historySize:  256,
+		resumeWindow: 30 * time.Second,
+		maxBodySize:  DefaultMaxMessageSize,
+		maxSessions:  1000,
+		idleTimeout:  10 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithHeartbeat sets the interval of the comments sent on idle event streams
+// to keep proxies from closing them. The default is 30 seconds; zero disables
+// heartbeats.
+func WithHeartbeat(d time.Duration) HandlerOption {
+	return func(c *handlerConfig) {
+		c.heartbeat = d
+	}
+}
+
+// WithResumeWindow sets how long the SSE handler keeps a session after its
+// event stream closed, waiting for the client to reconnect. The default is
+// 30 seconds; zero ends the session with the stream.
+func WithResumeWindow(d time.Duration) HandlerOption {
+	return func(c *handlerConfig) {
+		c.resumeWindow = d
+	}
+}
+
+// WithMaxBodySize limits the size of the messages POSTed by clients. A larger
+// body is rejected with 413 Request Entity Too Large. The default is
+// DefaultMaxMessageSize.
+func WithMaxBodySize(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		if n > 0 {
+			c.maxBodySize = n
+		}
+	}
+}
+
+// WithMaxSessions limits the number of sessions a handler serves at once.
+// Requests that would start another session are rejected with 503 Service
+// Unavailable. The default is 1000; zero means no limit.
+func WithMaxSessions(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.maxSessions = n
+	}
+}
+
+// NewSSEHandler returns a handler serving each event stream as a new session
+// of server.
+func NewSSEHandler(server Server, opts ...HandlerOption) *SSEHandler {
+	return &SSEHandler{
+		server: server,
+		config: newHandlerConfig(opts),
+	}
+}
+
+// ServeHTTP opens an event stream for GET requests, accepts client messages
+// for POST requests and ends the session for DELETE requests.
+func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, done, ok := h.config.negotiate(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	switch r.Method {
+	case http.MethodGet:
+		h.serveEvents(w, r)
+	case http.MethodPost:
+		h.serveMessage(w, r)
+	case http.MethodDelete:
+		h.serveDelete(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveEvents streams a session's messages, starting a new session unless
+// the client resumes one with Last-Event-ID.
+func (h *SSEHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	sess, cursor, ok := h.resume(w, r.Header.Get("Last-Event-ID"))
+	if !ok {
+		return
+	}
+	if sess == nil {
+		sess = newSSESession(h.config.historySize)
+		sess.log.attach()
+		if !h.sessions.add(sess, h.config.maxSessions) {
+			http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+		go func() {
+			h.server.Serve(sess)
+			h.sessions.end(sess)
+		}()
+	}
+	events, err := sess.log.after(cursor)
+	if err != nil {
+		// The client missed messages that cannot be replayed.
+		h.sessions.end(sess)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	defer h.detach(sess)
+
+	startEventStream(w)
+	endpoint := strings.TrimSuffix(r.URL.Path, "/events") + "/request?sessionId=" + sess.id
+	writeSSEEvent(w, "", "endpoint", []byte(endpoint))
+	flusher.Flush()
+
+	heartbeat, stop := h.config.heartbeats()
+	defer stop()
+	sess.stream(w, r, events, cursor, func(id int64) string {
+		return sess.id + "-" + strconv.FormatInt(id, 10)
+	}, heartbeat)
+}
+
+// resume returns the session named by a Last-Event-ID of the form
+// "<session>-<event>" and the event to continue after, or nil if the ID has
+// another form. If the session is gone or already has a stream, it writes an
+// error response and reports false.
+func (h *SSEHandler) resume(w http.ResponseWriter, lastEventID string) (*sseSession, int64, bool) {
+	sessionID, event, ok := strings.Cut(lastEventID, "-")
+	if !ok {
+		return nil, 0, true
+	}
+	cursor, err := strconv.ParseInt(event, 10, 64)
+	if err != nil {
+		return nil, 0, true
+	}
+	sess, ok := h.sessions.get(sessionID)
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil, 0, false
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	if !sess.log.attach() {
+		http.Error(w, "event stream already open", http.StatusConflict)
+		return nil, 0, false
+	}
+	if sess.expiry != nil {
+		sess.expiry.Stop()
+		sess.expiry = nil
+	}
+	return sess, cursor, true
+}
+
+// detach is called when a session's event stream closes. The session ends
+// unless the client may still resume it.
+func (h *SSEHandler) detach(sess *sseSession) {
+	if h.config.resumeWindow <= 0 {
+		h.sessions.end(sess)
+		return
+	}
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	sess.log.detach()
+	sess.expiry = time.AfterFunc(h.config.resumeWindow, func() {
+		if !sess.log.isAttached() {
+			h.sessions.end(sess)
+		}
+	})
+}
+
+// startEventStream writes the headers of an event stream response.
+func startEventStream(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+}
+
+// heartbeats returns a channel ticking at the heartbeat interval, or nil if
+// heartbeats are disabled, and a function releasing it.
+func (c handlerConfig) heartbeats() (<-chan time.Time, func()) {
+	if c.heartbeat <= 0 {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(c.heartbeat)
+	return ticker.C, ticker.Stop
+}
+
+// newSessionID returns a random session ID.
+func newSessionID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// serveMessage hands a message POSTed by the client to its session.
+func (h *SSEHandler) serveMessage(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.get(r.URL.Query().Get("sessionId"))
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(h.config.maxBodySize)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	select {
+	case sess.incoming <- json.RawMessage(body):
+		w.WriteHeader(http.StatusAccepted)
+	case <-sess.closed:
+		http.Error(w, "session closed", http.StatusNotFound)
+	case <-r.Context().Done():
+	}
+}
+
+// serveDelete ends the session named by the POST URL, so that a client
+// closing on purpose does not leave it waiting out the resume window.
+func (h *SSEHandler) serveDelete(w http.ResponseWriter, r *http.Request) {
+	sess, ok := h.sessions.get(r.URL.Query().Get("sessionId"))
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	h.sessions.end(sess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sseSession is the Transport a Server serves a single SSE session over.
+// Messages are sent through a log so that a resumed stream can replay them.
+// WriteMessage blocks while the log is full of messages not yet written to
+// the open stream.
+type sseSession struct {
+	*eventSession
+	mu     sync.Mutex
+	expiry *time.Timer
+}
+
+func newSSESession(historySize int) *sseSession {
+	return &sseSession{eventSession: newEventSession(historySize)}
+}
+
+// WriteMessage sends a message on the event stream.
+func (s *sseSession) WriteMessage(message json.RawMessage) error {
+	select {
+	case <-s.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	return s.log.append(message, s.closed)
+}
@@ -0,0 +1,274 @@
+package transports
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// DefaultMaxMessageSize is the default limit on the size of a message read
+// by a StreamTransport.
+const DefaultMaxMessageSize = 4 << 20
+
+// ErrMessageTooLarge is returned by ReadMessage for a message exceeding the
+// maximum message size. The message is skipped and the stream stays usable.
+// A transport closed because of an oversized message reports an error that
+// merely wraps or matches it, such as a WebSocketCloseError.
+var ErrMessageTooLarge = errors.New("transports: message too large")
+
+// Framing selects how a StreamTransport delimits messages.
+type Framing int
+
+const (
+	// FramingNewline sends each message on a line of its own. Messages must
+	// not contain newlines.
+	FramingNewline Framing = iota
+	// FramingContentLength precedes each message with a Content-Length
+	// header, like the Language Server Protocol.
+	FramingContentLength
+	// FramingAuto detects the framing of each message read. Messages are
+	// written with the framing of the last message read, newline-delimited
+	// until then.
+	FramingAuto
+)
+
+// StreamTransport implements the Transport interface over a byte stream,
+// framing messages as newline-delimited JSON unless set otherwise with
+// WithFraming.
+type StreamTransport struct {
+	r       io.Reader
+	w       io.WriteCloser
+	maxSize int
+	framing Framing
+	// writeFraming is the framing of written messages, guarded by mu.
+	writeFraming Framing
+	reads        chan readResult
+	closed       chan struct{}
+	once         sync.Once
+	mu           sync.Mutex
+}
+
+type readResult struct {
+	msg json.RawMessage
+	err error
+}
+
+// StreamOption configures a StreamTransport.
+type StreamOption func(*StreamTransport)
+
+// WithMaxMessageSize sets the maximum size of a message read from the
+// stream, not counting the newline. The default is DefaultMaxMessageSize.
+func WithMaxMessageSize(n int) StreamOption {
+	return func(t *StreamTransport) {
+		t.maxSize = n
+	}
+}
+
+// WithFraming sets how messages are delimited. The default is
+// FramingNewline.
+func WithFraming(f Framing) StreamOption {
+	return func(t *StreamTransport) {
+		t.framing = f
+	}
+}
+
+// NewStreamTransport creates a transport reading messages from r and writing
+// them to w.
+func NewStreamTransport(r io.Reader, w io.WriteCloser, opts ...StreamOption) *StreamTransport {
+	t := &StreamTransport{
+		r:       r,
+		w:       w,
+		maxSize: DefaultMaxMessageSize,
+		reads:   make(chan readResult),
+		closed:  make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	t.writeFraming = t.framing
+	if t.framing == FramingAuto {
+		t.writeFraming = FramingNewline
+	}
+	go t.readLoop()
+	return t
+}
+
+// readLoop reads messages from the stream and hands them to ReadMessage. Reading
+// happens here rather than in ReadMessage so that Close can unblock a pending
+// ReadMessage even if r cannot be closed.
+func (t *StreamTransport) readLoop() {
+	reader := bufio.NewReader(t.r)
+	for {
+		msg, err := t.read(reader)
+		select {
+		case t.reads <- readResult{msg, err}:
+		case <-t.closed:
+			return
+		}
+		if err != nil && err != ErrMessageTooLarge {
+			return
+		}
+	}
+}
+
+// read reads the next message with the configured framing.
+func (t *StreamTransport) read(reader *bufio.Reader) (json.RawMessage, error) {
+	switch t.framing {
+	case FramingContentLength:
+		return t.readContentLength(reader)
+	case FramingAuto:
+		// JSON messages start with an object or array; anything else is
+		// taken for a header.
+		b, err := skipSpace(reader)
+		if err != nil {
+			return nil, err
+		}
+		if b == '{' || b == '[' {
+			t.setWriteFraming(FramingNewline)
+			return t.readLine(reader)
+		}
+		t.setWriteFraming(FramingContentLength)
+		return t.readContentLength(reader)
+	}
+	return t.readLine(reader)
+}
+
+// skipSpace skips whitespace and returns the next byte without consuming it.
+func skipSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+func (t *StreamTransport) setWriteFraming(f Framing) {
+	t.mu.Lock()
+	t.writeFraming = f
+	t.mu.Unlock()
+}
+
+// readContentLength reads a message preceded by headers, of which only
+// Content-Length is used. A message exceeding the maximum size is skipped.
+func (t *StreamTransport) readContentLength(reader *bufio.Reader) (json.RawMessage, error) {
+	if _, err := skipSpace(reader); err != nil {
+		return nil, err
+	}
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	value := header.Get("Content-Length")
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("transports: invalid Content-Length header %q", value)
+	}
+	if length > int64(t.maxSize) {
+		if _, err := io.CopyN(io.Discard, reader, length); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, ErrMessageTooLarge
+	}
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(reader, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return json.RawMessage(msg), nil
+}
+
+// readLine reads the next non-empty line, enforcing the maximum size.
+func (t *StreamTransport) readLine(reader *bufio.Reader) (json.RawMessage, error) {
+	for {
+		var line []byte
+		tooLarge := false
+		for {
+			chunk, err := reader.ReadSlice('\n')
+			if !tooLarge {
+				line = append(line, chunk...)
+				if len(bytes.TrimRight(line, "\r\n")) > t.maxSize {
+					tooLarge = true
+					line = nil
+				}
+			}
+			if err == bufio.ErrBufferFull {
+				continue
+			}
+			if err != nil && (err != io.EOF || len(line) == 0) {
+				return nil, err
+			}
+			break
+		}
+		if tooLarge {
+			return nil, ErrMessageTooLarge
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			return json.RawMessage(line), nil
+		}
+	}
+}
+
+// ReadMessage reads the next message from the stream. The message is not
+// validated, so that a server can answer malformed input with a parse error.
+// It returns io.EOF once the stream has ended or the transport is closed.
+func (t *StreamTransport) ReadMessage() (json.RawMessage, error) {
+	select {
+	case r := <-t.reads:
+		return r.msg, r.err
+	case <-t.closed:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage writes a message to the stream, followed by a newline or
+// preceded by a Content-Length header.
+func (t *StreamTransport) WriteMessage(message json.RawMessage) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	var buf []byte
+	if t.writeFraming == FramingContentLength {
+		buf = fmt.Appendf(nil, "Content-Length: %d\r\n\r\n%s", len(message), message)
+	} else {
+		buf = append(message, '\n')
+	}
+	_, err := t.w.Write(buf)
+	return err
+}
+
+// Close closes both ends of the stream and unblocks pending reads.
+func (t *StreamTransport) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.closed)
+		if c, ok := t.r.(io.Closer); ok {
+			err = c.Close()
+		}
+		t.mu.Lock()
+		if wErr := t.w.Close(); err == nil {
+			err = wErr
+		}
+		t.mu.Unlock()
+	})
+	return err
+}
@@ -0,0 +1,283 @@
+package transports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrSessionNotFound is returned when the server no longer knows the
+// session, e.g. because it was restarted or terminated the session.
+var ErrSessionNotFound = errors.New("transports: session not found")
+
+// StreamableHTTPTransport implements the Transport interface using the
+// Streamable HTTP transport. Messages are POSTed to a single endpoint; the
+// responses come back as JSON or on an event stream. Once the server assigns
+// a session, a GET event stream receives the messages the server sends on
+// its own, resuming with Last-Event-ID after a disconnect.
+type StreamableHTTPTransport struct {
+	url         string
+	http        httpClient
+	incoming    chan readResult
+	mu          sync.Mutex
+	sessionID   string
+	lastEventID string
+	gone        chan struct{}
+	goneOnce    sync.Once
+	ctx         context.Context
+	cancel      context.CancelFunc
+	stop        chan struct{}
+	closeOnce   sync.Once
+	wg          sync.WaitGroup
+}
+
+// StreamableOption configures a StreamableHTTPTransport. The HTTPOptions
+// apply to it.
+type StreamableOption interface {
+	applyStreamable(t *StreamableHTTPTransport)
+}
+
+// NewStreamableHTTPTransport creates a transport talking to the MCP endpoint
+// at url.
+func NewStreamableHTTPTransport(url string, opts ...StreamableOption) *StreamableHTTPTransport {
+	t := &StreamableHTTPTransport{
+		url:      url,
+		http:     newHTTPClient(),
+		incoming: make(chan readResult),
+		gone:     make(chan struct{}),
+		stop:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt.applyStreamable(t)
+	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	return t
+}
+
+// SessionID returns the session ID assigned by the server, or "" before the
+// session was initialized.
+func (t *StreamableHTTPTransport) SessionID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sessionID
+}
+
+// ReadMessage reads the next message sent by the server. It returns
+// ErrSessionNotFound once the server has dropped the session, and
+// ErrMessageTooLarge for a skipped message.
+func (t *StreamableHTTPTransport) ReadMessage() (json.RawMessage, error) {
+	select {
+	case r := <-t.incoming:
+		return r.msg, r.err
+	case <-t.gone:
+		return nil, ErrSessionNotFound
+	case <-t.stop:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage POSTs a message to the server. Responses to the requests in
+// it are delivered through ReadMessage.
+func (t *StreamableHTTPTransport) WriteMessage(message json.RawMessage) error {
+	body, coding := t.http.encode(message)
+	req, err := http.NewRequestWithContext(t.ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if coding != "" {
+		req.Header.Set("Content-Encoding", coding)
+	}
+	req.Header.Set("Accept", "application/json, text/event-stream")
+	sessionID := t.SessionID()
+	if sessionID != "" {
+		req.Header.Set(SessionIDHeader, sessionID)
+	}
+	resp, err := t.http.do(req)
+	if err != nil {
+		return err
+	}
+	if sessionID == "" {
+		if id := resp.Header.Get(SessionIDHeader); id != "" {
+			t.mu.Lock()
+			t.sessionID = id
+			t.mu.Unlock()
+			t.goAsync(t.listen)
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound && sessionID != "":
+		resp.Body.Close()
+		t.sessionGone()
+		return ErrSessionNotFound
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		resp.Body.Close()
+		return fmt.Errorf("unexpected status: %d", resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "text/event-stream":
+		if !t.goAsync(func() { t.readEvents(resp.Body, false) }) {
+			resp.Body.Close()
+		}
+		return nil
+	case "application/json":
+		defer resp.Body.Close()
+		body, err := io.ReadAll(io.LimitReader(resp.Body, int64(t.http.maxSize)+1))
+		if err != nil {
+			return err
+		}
+		if len(body) > t.http.maxSize {
+			t.send(readResult{err: ErrMessageTooLarge})
+			return nil
+		}
+		t.deliver(body)
+		return nil
+	default:
+		resp.Body.Close()
+		return nil
+	}
+}
+
+// goAsync runs f in a goroutine Close waits for, unless the transport is
+// already closed.
+func (t *StreamableHTTPTransport) goAsync(f func()) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-t.stop:
+		return false
+	default:
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// listen keeps the GET event stream open, reconnecting with Last-Event-ID
+// until the transport is closed or the server drops the session.
+func (t *StreamableHTTPTransport) listen() {
+	retry := time.Second
+	for {
+		req, err := http.NewRequestWithContext(t.ctx, http.MethodGet, t.url, nil)
+		if err != nil {
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		t.mu.Lock()
+		req.Header.Set(SessionIDHeader, t.sessionID)
+		if t.lastEventID != "" {
+			req.Header.Set("Last-Event-ID", t.lastEventID)
+		}
+		t.mu.Unlock()
+		resp, err := t.http.do(req)
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusOK:
+				if r := t.readEvents(resp.Body, true); r > 0 {
+					retry = r
+				}
+			case http.StatusMethodNotAllowed:
+				// The server does not offer a GET stream.
+				resp.Body.Close()
+				return
+			case http.StatusNotFound:
+				resp.Body.Close()
+				t.sessionGone()
+				return
+			}
+			resp.Body.Close()
+		}
+		select {
+		case <-time.After(retry):
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// readEvents delivers the messages of an event stream and returns the retry
+// interval requested by the server, if any. The IDs of events on the GET
+// stream are remembered for resumption.
+func (t *StreamableHTTPTransport) readEvents(body io.ReadCloser, resumable bool) time.Duration {
+	defer body.Close()
+	t.mu.Lock()
+	events := newSSEReader(body, t.lastEventID, t.http.maxSize)
+	t.mu.Unlock()
+	for {
+		ev, err := events.next()
+		if resumable {
+			t.mu.Lock()
+			t.lastEventID = events.lastID
+			t.mu.Unlock()
+		}
+		if err == ErrMessageTooLarge {
+			t.send(readResult{err: err})
+			continue
+		}
+		if err != nil {
+			return events.retry
+		}
+		if ev.event == "message" {
+			t.deliver([]byte(ev.data))
+		}
+	}
+}
+
+// deliver hands a message to ReadMessage.
+func (t *StreamableHTTPTransport) deliver(msg []byte) {
+	if len(bytes.TrimSpace(msg)) == 0 {
+		return
+	}
+	t.send(readResult{msg: json.RawMessage(msg)})
+}
+
+// send hands the result of a read to ReadMessage.
+func (t *StreamableHTTPTransport) send(r readResult) {
+	select {
+	case t.incoming <- r:
+	case <-t.stop:
+	}
+}
+
+// sessionGone records that the server dropped the session.
+func (t *StreamableHTTPTransport) sessionGone() {
+	t.goneOnce.Do(func() {
+		close(t.gone)
+	})
+}
+
+// Close terminates the session with a DELETE request and shuts down the
+// transport.
+func (t *StreamableHTTPTransport) Close() error {
+	t.closeOnce.Do(func() {
+		t.mu.Lock()
+		close(t.stop)
+		t.mu.Unlock()
+		t.cancel()
+		if sessionID := t.SessionID(); sessionID != "" {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, http.MethodDelete, t.url, nil)
+			if err == nil {
+				req.Header.Set(SessionIDHeader, sessionID)
+				if resp, err := t.http.do(req); err == nil {
+					resp.Body.Close()
+				}
+			}
+		}
+		t.wg.Wait()
+	})
+	return nil
+}
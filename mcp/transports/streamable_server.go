@@ -0,0 +1,501 @@
+package transports
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SessionIDHeader is the header carrying the session ID of the Streamable
+// HTTP transport.
+const SessionIDHeader = "Mcp-Session-Id"
+
+// StreamableHTTPHandler is an http.Handler serving a Server over the
+// Streamable HTTP transport on a single endpoint:
+//
+//   - POST sends client messages. An initialize request starts a new session
+//     whose ID is returned in the Mcp-Session-Id header. The responses to the
+//     requests in a POST are returned as JSON or on an event stream.
+//   - GET opens an event stream for messages the server sends on its own,
+//     such as notifications. It resumes after the Last-Event-ID if given.
+//   - DELETE terminates the session.
+//
+// A session that no request uses for the idle timeout ends as well; see
+// WithSessionIdleTimeout.
+type StreamableHTTPHandler struct {
+	server   Server
+	config   handlerConfig
+	sessions sessionTable[*streamableSession]
+}
+
+// WithJSONResponses makes the Streamable HTTP handler answer POSTed requests
+// with a JSON body instead of an event stream.
+func WithJSONResponses() HandlerOption {
+	return func(c *handlerConfig) {
+		c.jsonResponses = true
+	}
+}
+
+// WithEventHistory sets how many events sent on a session's standalone event
+// stream are kept for resumption with Last-Event-ID. The default is 256. As
+// many events may wait for an open stream before the session's writes
+// block; with no stream open, the oldest are dropped instead.
+func WithEventHistory(n int) HandlerOption {
+	return func(c *handlerConfig) {
+		c.historySize = n
+	}
+}
+
+// WithSessionIdleTimeout sets how long the Streamable HTTP handler keeps a
+// session that no request uses, including an open event stream. The default
+// is 10 minutes; zero keeps sessions until the client deletes them.
+func WithSessionIdleTimeout(d time.Duration) HandlerOption {
+	return func(c *handlerConfig) {
+		c.idleTimeout = d
+	}
+}
+
+// NewStreamableHTTPHandler returns a handler serving each session started by
+// an initialize request as a new session of server.
+func NewStreamableHTTPHandler(server Server, opts ...HandlerOption) *StreamableHTTPHandler {
+	return &StreamableHTTPHandler{
+		server: server,
+		config: newHandlerConfig(opts),
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *StreamableHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w, done, ok := h.config.negotiate(w, r)
+	if !ok {
+		return
+	}
+	defer done()
+	switch r.Method {
+	case http.MethodPost:
+		h.servePost(w, r)
+	case http.MethodGet:
+		h.serveGet(w, r)
+	case http.MethodDelete:
+		h.serveDelete(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// session returns the session named by the request's Mcp-Session-Id header,
+// or writes an error response and returns nil.
+func (h *StreamableHTTPHandler) session(w http.ResponseWriter, r *http.Request) *streamableSession {
+	id := r.Header.Get(SessionIDHeader)
+	if id == "" {
+		http.Error(w, "missing "+SessionIDHeader+" header", http.StatusBadRequest)
+		return nil
+	}
+	sess, ok := h.sessions.get(id)
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return nil
+	}
+	return sess
+}
+
+// startSession starts serving a new session, or returns nil if the handler
+// serves as many sessions as it may.
+func (h *StreamableHTTPHandler) startSession() *streamableSession {
+	sess := newStreamableSession(h.config.historySize)
+	if !h.sessions.add(sess, h.config.maxSessions) {
+		return nil
+	}
+	go func() {
+		h.server.Serve(sess)
+		h.sessions.end(sess)
+	}()
+	return sess
+}
+
+// use marks a session as used by a request until the returned function is
+// called. A session no request uses ends after the idle timeout.
+func (h *StreamableHTTPHandler) use(sess *streamableSession) func() {
+	sess.mu.Lock()
+	sess.users++
+	sess.mu.Unlock()
+	return func() {
+		sess.mu.Lock()
+		defer sess.mu.Unlock()
+		if sess.users--; sess.users > 0 || h.config.idleTimeout <= 0 {
+			return
+		}
+		if sess.idle != nil {
+			sess.idle.Reset(h.config.idleTimeout)
+			return
+		}
+		sess.idle = time.AfterFunc(h.config.idleTimeout, func() {
+			sess.mu.Lock()
+			idle := sess.users == 0
+			sess.mu.Unlock()
+			if idle {
+				h.sessions.end(sess)
+			}
+		})
+	}
+}
+
+// servePost hands the POSTed messages to the session and returns the
+// responses to the requests among them.
+func (h *StreamableHTTPHandler) servePost(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(h.config.maxBodySize)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	requests, initialize, rejection := parseRequestIDs(body)
+	if rejection != "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, rejection)
+		return
+	}
+
+	var sess *streamableSession
+	if initialize && r.Header.Get(SessionIDHeader) == "" {
+		if sess = h.startSession(); sess == nil {
+			http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+			return
+		}
+	} else if sess = h.session(w, r); sess == nil {
+		return
+	}
+	defer h.use(sess)()
+	w.Header().Set(SessionIDHeader, sess.id)
+
+	responses := sess.await(requests)
+	select {
+	case sess.incoming <- json.RawMessage(body):
+	case <-sess.closed:
+		http.Error(w, "session closed", http.StatusNotFound)
+		return
+	case <-r.Context().Done():
+		sess.abandon(requests, responses)
+		return
+	}
+	if len(requests) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if h.config.jsonResponses || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.writeJSON(w, r, sess, requests, responses)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeJSON(w, r, sess, requests, responses)
+		return
+	}
+	startEventStream(w)
+	flusher.Flush()
+	heartbeat, stop := h.config.heartbeats()
+	defer stop()
+	remaining := len(requests)
+	for remaining > 0 {
+		select {
+		case msg := <-responses:
+			remaining -= len(responseIDs(msg))
+			// Responses are not logged, so their events carry no ID.
+			if err := writeSSEEvent(w, "", "message", msg); err != nil {
+				sess.abandon(requests, responses)
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				sess.abandon(requests, responses)
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			sess.abandon(requests, responses)
+			return
+		case <-sess.closed:
+			return
+		}
+	}
+}
+
+// writeJSON waits for the responses to the requests and writes them as the
+// JSON body of the response.
+func (h *StreamableHTTPHandler) writeJSON(w http.ResponseWriter, r *http.Request, sess *streamableSession, requests []string, responses chan json.RawMessage) {
+	var msgs []json.RawMessage
+	for remaining := len(requests); remaining > 0; {
+		select {
+		case msg := <-responses:
+			remaining -= len(responseIDs(msg))
+			msgs = append(msgs, msg)
+		case <-r.Context().Done():
+			sess.abandon(requests, responses)
+			return
+		case <-sess.closed:
+			http.Error(w, "session closed", http.StatusNotFound)
+			return
+		}
+	}
+	body := msgs[0]
+	if len(msgs) > 1 {
+		body, _ = json.Marshal(msgs)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+// serveGet streams the messages the session sends outside of any POST.
+func (h *StreamableHTTPHandler) serveGet(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		http.Error(w, "must accept text/event-stream", http.StatusNotAcceptable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusMethodNotAllowed)
+		return
+	}
+	sess := h.session(w, r)
+	if sess == nil {
+		return
+	}
+	defer h.use(sess)()
+	cursor, ok := sess.openStream(r.Header.Get("Last-Event-ID"))
+	if !ok {
+		http.Error(w, "event stream already open", http.StatusConflict)
+		return
+	}
+	events, err := sess.log.after(cursor)
+	if err != nil {
+		// The client missed messages that cannot be replayed.
+		h.sessions.end(sess)
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer sess.closeStream()
+
+	startEventStream(w)
+	flusher.Flush()
+	heartbeat, stop := h.config.heartbeats()
+	defer stop()
+	sess.stream(w, r, events, cursor, func(id int64) string {
+		return strconv.FormatInt(id, 10)
+	}, heartbeat)
+}
+
+// serveDelete terminates a session.
+func (h *StreamableHTTPHandler) serveDelete(w http.ResponseWriter, r *http.Request) {
+	sess := h.session(w, r)
+	if sess == nil {
+		return
+	}
+	h.sessions.end(sess)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// JSON-RPC error responses to POSTs rejected before reaching the session.
+// Their null id could not be matched to a request of the POST.
+const (
+	parseErrorResponse     = `{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`
+	invalidRequestResponse = `{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`
+)
+
+// parseRequestIDs returns the IDs of the requests in a message or batch, and
+// whether one of them is an initialize request. If the body is not valid
+// JSON, or a request has an ID other than a string, an integer or null or
+// fields of the wrong type, it returns the error response rejecting the POST
+// instead.
+func parseRequestIDs(body []byte) (ids []string, initialize bool, rejection string) {
+	if !json.Valid(body) {
+		return nil, false, parseErrorResponse
+	}
+	for _, entry := range splitBatch(body) {
+		var m struct {
+			JSONRPC string          `json:"jsonrpc"`
+			ID      json.RawMessage `json:"id"`
+			Method  string          `json:"method"`
+			Result  json.RawMessage `json:"result"`
+			Error   json.RawMessage `json:"error"`
+		}
+		// A field of the wrong type still leaves the others decoded.
+		err := json.Unmarshal(entry, &m)
+		if m.ID == nil || m.Result != nil || m.Error != nil {
+			continue
+		}
+		if err != nil || !validID(m.ID) {
+			return nil, false, invalidRequestResponse
+		}
+		ids = append(ids, idKey(m.ID))
+		if m.Method == "initialize" {
+			initialize = true
+		}
+	}
+	return ids, initialize, ""
+}
+
+// validID reports whether id is a string, an integer or null, the IDs a
+// server can echo back in its response.
+func validID(id json.RawMessage) bool {
+	id = bytes.TrimSpace(id)
+	if string(id) == "null" {
+		return true
+	}
+	if len(id) > 0 && id[0] == '"' {
+		var s string
+		return json.Unmarshal(id, &s) == nil
+	}
+	digits := bytes.TrimPrefix(id, []byte("-"))
+	if len(digits) == 0 || (digits[0] == '0' && len(digits) > 1) {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// responseIDs returns the IDs of the responses in a message or batch.
+func responseIDs(msg json.RawMessage) []string {
+	var ids []string
+	for _, entry := range splitBatch(msg) {
+		var m struct {
+			ID     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if json.Unmarshal(entry, &m) != nil || m.Method != "" || m.ID == nil {
+			continue
+		}
+		ids = append(ids, idKey(m.ID))
+	}
+	return ids
+}
+
+// splitBatch returns the entries of a batch, or msg itself if it is not one.
+func splitBatch(msg []byte) []json.RawMessage {
+	trimmed := bytes.TrimSpace(msg)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if json.Unmarshal(trimmed, &batch) == nil {
+			return batch
+		}
+	}
+	return []json.RawMessage{msg}
+}
+
+// idKey returns the canonical form of a JSON-RPC ID.
+func idKey(id json.RawMessage) string {
+	var buf bytes.Buffer
+	if json.Compact(&buf, id) != nil {
+		return string(id)
+	}
+	return buf.String()
+}
+
+// streamableSession is the Transport a Server serves a Streamable HTTP
+// session over. Responses are routed to the POST carrying their request;
+// other messages go to the GET event stream, through a log kept for
+// resumption. WriteMessage blocks while the log is full of messages not yet
+// written to the open stream.
+type streamableSession struct {
+	*eventSession
+	mu      sync.Mutex
+	waiters map[string]chan json.RawMessage
+	// users counts the requests using the session; once none does, idle
+	// ends it after the idle timeout.
+	users int
+	idle  *time.Timer
+}
+
+func newStreamableSession(historySize int) *streamableSession {
+	return &streamableSession{
+		eventSession: newEventSession(historySize),
+		waiters:      make(map[string]chan json.RawMessage),
+	}
+}
+
+// WriteMessage routes a message to the POST waiting for it or, failing
+// that, to the GET event stream.
+func (s *streamableSession) WriteMessage(message json.RawMessage) error {
+	select {
+	case <-s.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	s.mu.Lock()
+	ids := responseIDs(message)
+	for _, id := range ids {
+		if ch, ok := s.waiters[id]; ok {
+			for _, id := range ids {
+				delete(s.waiters, id)
+			}
+			ch <- message
+			s.mu.Unlock()
+			return nil
+		}
+	}
+	s.mu.Unlock()
+	return s.log.append(message, s.closed)
+}
+
+// await registers interest in the responses to the given requests. The
+// channel has room for all of them, so WriteMessage never blocks on it.
+func (s *streamableSession) await(requests []string) chan json.RawMessage {
+	ch := make(chan json.RawMessage, len(requests))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range requests {
+		s.waiters[id] = ch
+	}
+	return ch
+}
+
+// abandon is called when a POST ends before all its responses were written.
+// The remaining responses are sent on the GET event stream instead.
+func (s *streamableSession) abandon(requests []string, responses chan json.RawMessage) {
+	s.mu.Lock()
+	for _, id := range requests {
+		if s.waiters[id] == responses {
+			delete(s.waiters, id)
+		}
+	}
+	s.mu.Unlock()
+	for {
+		select {
+		case msg := <-responses:
+			if s.log.append(msg, s.closed) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// openStream marks the GET event stream as open and returns the ID of the
+// last event the client has seen: lastEventID if given, otherwise the last
+// one delivered. It reports false if a stream is already open.
+func (s *streamableSession) openStream(lastEventID string) (int64, bool) {
+	if !s.log.attach() {
+		return 0, false
+	}
+	if id, err := strconv.ParseInt(lastEventID, 10, 64); err == nil {
+		return id, true
+	}
+	return s.log.lastDelivered(), true
+}
+
+// closeStream marks the GET event stream as closed.
+func (s *streamableSession) closeStream() {
+	s.log.detach()
+}
@@ -0,0 +1,562 @@
+package transports
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// WebSocketSubprotocol is the subprotocol negotiated for MCP over WebSocket.
+const WebSocketSubprotocol = "mcp"
+
+// WebSocket close codes.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidData     = 1007
+	CloseMessageTooLarge = 1009
+	CloseInternalError   = 1011
+)
+
+// ErrKeepaliveTimeout is returned by ReadMessage when the peer did not
+// answer a ping within the ping interval.
+var ErrKeepaliveTimeout = errors.New("transports: websocket keepalive timed out")
+
+// WebSocketCloseError is returned by ReadMessage when the connection was
+// closed with a code other than a normal closure, which is reported as
+// io.EOF. A CloseMessageTooLarge error matches ErrMessageTooLarge.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("transports: websocket closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("transports: websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// Unwrap maps the close code to the corresponding transport error.
+func (e *WebSocketCloseError) Unwrap() error {
+	if e.Code == CloseMessageTooLarge {
+		return ErrMessageTooLarge
+	}
+	return nil
+}
+
+// WebSocketOption configures a WebSocket transport, on the client or the
+// server side.
+type WebSocketOption func(*webSocketConfig)
+
+type webSocketConfig struct {
+	maxSize      int
+	pingInterval time.Duration
+	tlsConfig    *tls.Config
+	header       http.Header
+	// origins lists the origins the handler accepts besides its own host.
+	origins []string
+}
+
+func newWebSocketConfig(opts []WebSocketOption) webSocketConfig {
+	c := webSocketConfig{
+		maxSize:      DefaultMaxMessageSize,
+		pingInterval: 30 * time.Second,
+		header:       make(http.Header),
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithReadLimit sets the maximum size of a message read from the
+// connection. The default is DefaultMaxMessageSize. A larger message closes
+// the connection with CloseMessageTooLarge.
+func WithReadLimit(n int) WebSocketOption {
+	return func(c *webSocketConfig) {
+		c.maxSize = n
+	}
+}
+
+// WithPingInterval sets how often a ping is sent. A peer that has not
+// answered by the next ping is considered gone. The default is 30 seconds;
+// zero disables pings.
+func WithPingInterval(d time.Duration) WebSocketOption {
+	return func(c *webSocketConfig) {
+		c.pingInterval = d
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used to dial wss:// URLs.
+func WithTLSConfig(config *tls.Config) WebSocketOption {
+	return func(c *webSocketConfig) {
+		c.tlsConfig = config
+	}
+}
+
+// WithDialHeader adds a header sent with the opening handshake.
+func WithDialHeader(key, value string) WebSocketOption {
+	return func(c *webSocketConfig) {
+		c.header.Add(key, value)
+	}
+}
+
+// WithAllowedOrigins makes the handler accept browser connections from the
+// given origins, e.g. "https://app.example.com", besides those from the host
+// it is served on. "*" accepts any origin. Requests without an Origin
+// header, as sent by clients other than browsers, are always accepted.
+func WithAllowedOrigins(origins ...string) WebSocketOption {
+	return func(c *webSocketConfig) {
+		c.origins = append(c.origins, origins...)
+	}
+}
+
+// WebSocket opcodes.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// WebSocketTransport implements the Transport interface over a WebSocket
+// connection. Every message is sent as a text message.
+type WebSocketTransport struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	client  bool
+	config  webSocketConfig
+	reads   chan json.RawMessage
+	done    chan struct{}
+	err     error
+	writeMu sync.Mutex
+	// closeSent is set once a close frame was written; no frames may follow.
+	closeSent bool
+	pongs     chan struct{}
+	timedOut  atomic.Bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// DialWebSocket opens a WebSocket connection to a ws:// or wss:// URL and
+// negotiates the mcp subprotocol.
+func DialWebSocket(ctx context.Context, rawURL string, opts ...WebSocketOption) (*WebSocketTransport, error) {
+	config := newWebSocketConfig(opts)
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", hostPort(u, "80"))
+	case "wss":
+		d := tls.Dialer{Config: config.tlsConfig}
+		conn, err = d.DialContext(ctx, "tcp", hostPort(u, "443"))
+	default:
+		return nil, fmt.Errorf("transports: unsupported websocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Abort the handshake when ctx is done.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	br, err := handshake(conn, u, config.header)
+	if !stop() {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newWebSocketTransport(conn, br, true, config), nil
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+// handshake sends the opening handshake and checks the server's answer.
+func handshake(conn net.Conn, u *url.URL, header http.Header) (*bufio.Reader, error) {
+	var nonce [16]byte
+	rand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: "http", Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header.Clone(),
+		Host:       u.Host,
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", WebSocketSubprotocol)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, fmt.Errorf("transports: websocket handshake: unexpected status: %d", resp.StatusCode)
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !headerContains(resp.Header, "Connection", "upgrade"):
+		return nil, errors.New("transports: websocket handshake: connection not upgraded")
+	case resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key):
+		return nil, errors.New("transports: websocket handshake: bad Sec-WebSocket-Accept")
+	case resp.Header.Get("Sec-WebSocket-Protocol") != WebSocketSubprotocol:
+		return nil, fmt.Errorf("transports: websocket handshake: server chose subprotocol %q", resp.Header.Get("Sec-WebSocket-Protocol"))
+	case resp.Header.Get("Sec-WebSocket-Extensions") != "":
+		return nil, errors.New("transports: websocket handshake: unexpected extensions")
+	}
+	return br, nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a key.
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// headerContains reports whether the comma-separated header contains token,
+// ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newWebSocketTransport(conn net.Conn, br *bufio.Reader, client bool, config webSocketConfig) *WebSocketTransport {
+	t := &WebSocketTransport{
+		conn:   conn,
+		br:     br,
+		client: client,
+		config: config,
+		reads:  make(chan json.RawMessage),
+		done:   make(chan struct{}),
+		pongs:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+	go t.readLoop()
+	if config.pingInterval > 0 {
+		go t.keepalive()
+	}
+	return t
+}
+
+// readLoop reads messages until the connection fails or is closed, then
+// records why and closes the connection.
+func (t *WebSocketTransport) readLoop() {
+	defer close(t.done)
+	for {
+		msg, err := t.readMessage()
+		if err != nil {
+			t.finish(err)
+			return
+		}
+		select {
+		case t.reads <- msg:
+		case <-t.closed:
+			t.finish(io.EOF)
+			return
+		}
+	}
+}
+
+// finish records the error ending the connection and closes it.
+func (t *WebSocketTransport) finish(err error) {
+	var closeErr *WebSocketCloseError
+	switch {
+	case t.timedOut.Load():
+		err = ErrKeepaliveTimeout
+	case errors.As(err, &closeErr):
+		t.writeClose(closeErr.Code, closeErr.Reason)
+		if closeErr.Code == CloseNormal || closeErr.Code == CloseGoingAway || closeErr.Code == CloseNoStatus {
+			err = io.EOF
+		}
+	case errors.Is(err, ErrMessageTooLarge):
+		t.writeClose(CloseMessageTooLarge, "")
+		// Unlike a bare ErrMessageTooLarge, this tells the reader that the
+		// connection is gone.
+		err = &WebSocketCloseError{Code: CloseMessageTooLarge}
+	case err == io.EOF:
+		err = io.ErrUnexpectedEOF
+	}
+	select {
+	case <-t.closed:
+		err = io.EOF
+	default:
+	}
+	t.err = err
+	t.conn.Close()
+}
+
+// readMessage reads the frames of the next data message, answering control
+// frames in between.
+func (t *WebSocketTransport) readMessage() (json.RawMessage, error) {
+	var (
+		msg     []byte
+		started bool
+		text    bool
+	)
+	for {
+		fin, opcode, payload, err := t.readFrame(len(msg))
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case t.pongs <- struct{}{}:
+		default:
+		}
+		switch opcode {
+		case opPing:
+			t.writeFrame(opPong, payload)
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return nil, parseClose(payload)
+		case opText, opBinary:
+			if started {
+				return nil, &WebSocketCloseError{Code: CloseProtocolError, Reason: "expected continuation frame"}
+			}
+			started, text = true, opcode == opText
+		case opContinuation:
+			if !started {
+				return nil, &WebSocketCloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"}
+			}
+		default:
+			return nil, &WebSocketCloseError{Code: CloseProtocolError, Reason: "unknown opcode"}
+		}
+		msg = append(msg, payload...)
+		if fin {
+			if text && !utf8.Valid(msg) {
+				return nil, &WebSocketCloseError{Code: CloseInvalidData, Reason: "invalid UTF-8"}
+			}
+			return json.RawMessage(msg), nil
+		}
+	}
+}
+
+// readFrame reads a frame. buffered is the size of the message read so far,
+// used to enforce the read limit before the payload is read.
+func (t *WebSocketTransport) readFrame(buffered int) (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(t.br, head[:]); err != nil {
+		return
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+	if head[0]&0x70 != 0 {
+		err = &WebSocketCloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+		return
+	}
+	if masked == t.client {
+		err = &WebSocketCloseError{Code: CloseProtocolError, Reason: "bad masking"}
+		return
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(t.br, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(t.br, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode >= opClose && (!fin || length > 125) {
+		err = &WebSocketCloseError{Code: CloseProtocolError, Reason: "bad control frame"}
+		return
+	}
+	if opcode < opClose && length > uint64(t.config.maxSize-buffered) {
+		err = ErrMessageTooLarge
+		return
+	}
+	var mask [4]byte
+	if masked {
+		if _, err = io.ReadFull(t.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(t.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+// parseClose returns the error for a close frame.
+func parseClose(payload []byte) error {
+	if len(payload) < 2 {
+		return &WebSocketCloseError{Code: CloseNoStatus}
+	}
+	return &WebSocketCloseError{Code: int(binary.BigEndian.Uint16(payload)), Reason: string(payload[2:])}
+}
+
+// writeFrame writes an unfragmented frame, masked if sent by the client.
+func (t *WebSocketTransport) writeFrame(opcode byte, payload []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	if t.closeSent {
+		return io.ErrClosedPipe
+	}
+	if opcode == opClose {
+		t.closeSent = true
+	}
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+	var maskBit byte
+	if t.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+	if t.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		buf = append(buf, mask[:]...)
+		for i, b := range payload {
+			buf = append(buf, b^mask[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	_, err := t.conn.Write(buf)
+	return err
+}
+
+// writeClose sends a close frame, unless one was already sent.
+func (t *WebSocketTransport) writeClose(code int, reason string) {
+	if code == CloseNoStatus {
+		// The code must not be sent; the close frame is echoed empty.
+		t.writeFrame(opClose, nil)
+		return
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	t.writeFrame(opClose, append(payload, reason...))
+}
+
+// keepalive pings the peer and fails the connection when a ping interval
+// passes without any frame from the peer.
+func (t *WebSocketTransport) keepalive() {
+	ticker := time.NewTicker(t.config.pingInterval)
+	defer ticker.Stop()
+	alive := true
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+		select {
+		case <-t.pongs:
+			alive = true
+		default:
+		}
+		if !alive {
+			t.timedOut.Store(true)
+			t.conn.Close()
+			return
+		}
+		alive = false
+		if t.writeFrame(opPing, nil) != nil {
+			return
+		}
+	}
+}
+
+// ReadMessage reads the next message. After the peer closed the connection
+// normally, it returns io.EOF.
+func (t *WebSocketTransport) ReadMessage() (json.RawMessage, error) {
+	select {
+	case msg := <-t.reads:
+		return msg, nil
+	case <-t.done:
+		return nil, t.err
+	case <-t.closed:
+		return nil, io.EOF
+	}
+}
+
+// WriteMessage sends a message as a text message.
+func (t *WebSocketTransport) WriteMessage(message json.RawMessage) error {
+	return t.writeFrame(opText, message)
+}
+
+// Close sends a normal closure and waits briefly for the peer to acknowledge
+// it before closing the connection.
+func (t *WebSocketTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		t.writeClose(CloseNormal, "")
+		select {
+		case <-t.done:
+		case <-time.After(5 * time.Second):
+		}
+		t.conn.Close()
+	})
+	return nil
+}
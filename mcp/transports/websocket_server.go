@@ -0,0 +1,89 @@
+package transports
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// WebSocketHandler is an http.Handler serving a Server over WebSocket. Each
+// connection is upgraded and served as a new session. Clients must offer
+// the mcp subprotocol.
+type WebSocketHandler struct {
+	server Server
+	config webSocketConfig
+}
+
+// NewWebSocketHandler returns a handler serving each WebSocket connection as
+// a new session of server. Browsers may only connect from pages served by
+// the same host, unless WithAllowedOrigins admits other origins.
+func NewWebSocketHandler(server Server, opts ...WebSocketOption) *WebSocketHandler {
+	return &WebSocketHandler{server: server, config: newWebSocketConfig(opts)}
+}
+
+// ServeHTTP upgrades the connection and serves it until it is closed.
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || !headerContains(r.Header, "Connection", "upgrade") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if nonce, err := base64.StdEncoding.DecodeString(key); err != nil || len(nonce) != 16 {
+		http.Error(w, "bad Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	if !h.checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if !headerContains(r.Header, "Sec-WebSocket-Protocol", WebSocketSubprotocol) {
+		http.Error(w, "the mcp subprotocol is required", http.StatusBadRequest)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n" +
+		"Sec-WebSocket-Protocol: " + WebSocketSubprotocol + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	t := newWebSocketTransport(conn, rw.Reader, false, h.config)
+	defer t.Close()
+	h.server.Serve(t)
+}
+
+// checkOrigin reports whether the request's Origin, if any, is the host the
+// handler is served on or an allowed origin. This keeps web pages on other
+// sites from connecting with the browser's credentials.
+func (h *WebSocketHandler) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range h.config.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}